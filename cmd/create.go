@@ -7,6 +7,7 @@ package cmd
 import (
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -19,16 +20,45 @@ import (
 func init() {
 	rootCmd.AddCommand(createCmd)
 	createCmd.Flags().StringVarP(&NetCIDR, "net", "n", "", "CIDR Network for the environment")
+	createCmd.Flags().StringVar(&NetCIDR6, "net6", "", "IPv6 CIDR Network for dual-stack environments, e.g. fd00:10::/64")
+	createCmd.Flags().StringArrayVar(&envUserData, "cloud-init", nil, "Cloud-init user data file merged into the base template of every VM. Can be repeated")
+	createCmd.Flags().StringVar(&envDiskBus, "disk-bus", "scsi", "Default bus of the disks of the VMs: virtio, scsi or sata")
+	createCmd.Flags().StringVar(&envDiskCache, "disk-cache", "", "Default cache mode of the disks of the VMs, e.g. none or writeback")
+	createCmd.Flags().StringVar(&envDiskIO, "disk-io", "", "Default IO mode of the disks of the VMs: native, threads or io_uring")
+	createCmd.Flags().StringVar(&envNicModel, "nic-model", "virtio", "Default model of the network interfaces of the VMs")
+	createCmd.Flags().StringVar(&envNetMode, "net-mode", "nat", "Mode of the network: nat, route, isolated or bridge[:<bridge>], br0 by default")
+	createCmd.Flags().StringVar(&envHostAddress, "host-address", "", "Address of the host on the LAN in bridge mode, where cloud-init phones home")
+	createCmd.Flags().StringVar(&envIPRange, "ip-range", "", "Range of addresses of the LAN reserved for the VMs in bridge mode, as FIRST-LAST")
 }
 
 var (
 	createCmd = &cobra.Command{
 		Use:   "create env",
 		Short: "Create a new environment",
-		Long:  "Create a new environment empty environment with only the virtual network",
-		RunE:  create,
-	}
-	NetCIDR string
+		Long: `Create a new environment empty environment with only the virtual network.
+
+The network is NATed by default. In route mode, the LAN must route the
+network to the host. In isolated mode, the VMs can only reach the host and
+each other. In bridge mode, the VMs are on the LAN of the bridge of the
+host: the network given with --net must be the one of the LAN, its first
+address being the gateway, and libvirt does not serve the DNS of the VMs.
+The address of the host on the LAN must be given with --host-address. The
+addresses of the VMs are only chosen by carcass inside the range given with
+--ip-range, they must be given to vm add otherwise`,
+		RunE: create,
+	}
+	NetCIDR     string
+	NetCIDR6    string
+	envUserData []string
+
+	envDiskBus   string
+	envDiskCache string
+	envDiskIO    string
+	envNicModel  string
+	envNetMode   string
+
+	envHostAddress string
+	envIPRange     string
 )
 
 func create(cmd *cobra.Command, args []string) error {
@@ -42,6 +72,50 @@ func create(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("invalid environment name")
 	}
 
+	if err := terraform.CheckDeviceOptions(envDiskBus, envDiskCache, envDiskIO, envNicModel); err != nil {
+		return err
+	}
+
+	netMode, bridge, err := terraform.ParseNetMode(envNetMode)
+	if err != nil {
+		return err
+	}
+
+	if netMode == "bridge" {
+		if NetCIDR == "" {
+			return fmt.Errorf("the network of the LAN must be given with --net in bridge mode")
+		}
+
+		if envHostAddress == "" {
+			return fmt.Errorf("the address of the host on the LAN must be given with --host-address in bridge mode")
+		}
+
+		_, ipnet, err := net.ParseCIDR(NetCIDR)
+		if err != nil {
+			return fmt.Errorf("invalid network: %s", NetCIDR)
+		}
+
+		if ip := net.ParseIP(envHostAddress); ip == nil || !ipnet.Contains(ip) {
+			return fmt.Errorf("invalid host address %s, it must be in network %s", envHostAddress, ipnet)
+		}
+
+		if envIPRange != "" {
+			if _, _, err := terraform.ParseIPRange(NetCIDR, envIPRange); err != nil {
+				return err
+			}
+		}
+	} else if envHostAddress != "" || envIPRange != "" {
+		return fmt.Errorf("--host-address and --ip-range are only used in bridge mode")
+	}
+
+	if NetCIDR6 != "" {
+		ip, ipnet, err := net.ParseCIDR(NetCIDR6)
+		if err != nil || ip.To4() != nil {
+			return fmt.Errorf("invalid IPv6 network: %s", NetCIDR6)
+		}
+		NetCIDR6 = ipnet.String()
+	}
+
 	envPath, err := environmentDir(DataDir, envName)
 	if err != nil {
 		return fmt.Errorf("invalid data directory: %w", err)
@@ -68,10 +142,13 @@ func create(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	// create the dnsmasq configuration
-	err = configureDnsmasq("/etc/dnsmasq.d/", envName)
-	if err != nil {
-		return err
+	// create the dnsmasq configuration, libvirt does not serve the DNS of
+	// bridged networks
+	if netMode != "bridge" {
+		err = configureDnsmasq("/etc/dnsmasq.d/", envName)
+		if err != nil {
+			return err
+		}
 	}
 
 	// get defaults from the user config file
@@ -81,6 +158,24 @@ func create(cmd *cobra.Command, args []string) error {
 		tfConfig.Module.SshPubKey = userConfig.SshPubKey
 	}
 
+	tfConfig.Module.DiskBus = envDiskBus
+	tfConfig.Module.DiskCache = envDiskCache
+	tfConfig.Module.DiskIO = envDiskIO
+	tfConfig.Module.NicModel = envNicModel
+	tfConfig.Module.NetworkCIDR6 = NetCIDR6
+	tfConfig.Module.NetworkMode = netMode
+	tfConfig.Module.Bridge = bridge
+	tfConfig.Module.HostAddress = envHostAddress
+	tfConfig.Module.IPRange = envIPRange
+
+	for _, src := range envUserData {
+		path, err := storeUserData(envName, envName, src)
+		if err != nil {
+			return err
+		}
+		tfConfig.Module.UserData = append(tfConfig.Module.UserData, path)
+	}
+
 	tfConfigDir := filepath.Join(envPath, "terraform")
 	err = os.MkdirAll(tfConfigDir, 0755)
 	if err != nil {
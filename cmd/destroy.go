@@ -53,6 +53,14 @@ func destroy(cmd *cobra.Command, args []string) {
 	binDir, _ := binaryDir(DataDir)
 	tfConfigDir := filepath.Join(envPath, "terraform")
 
+	// terraform refuses to destroy with providers missing from the lock
+	// file
+	if conf, err := terraform.ParseModuleConfig(filepath.Join(tfConfigDir, "main.tf")); err == nil {
+		if err := initEnvConfig(binDir, tfConfigDir, conf); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
 	err = terraform.Destroy(binDir, tfConfigDir)
 	if err != nil {
 		log.Fatalln(err)
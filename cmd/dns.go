@@ -0,0 +1,235 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/orgrim/carcass/hv"
+	"github.com/orgrim/carcass/terraform"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	dnsCmd.AddCommand(addDNSCmd)
+	dnsCmd.AddCommand(rmDNSCmd)
+	dnsCmd.AddCommand(listDNSCmd)
+	rootCmd.AddCommand(dnsCmd)
+}
+
+var (
+	dnsCmd = &cobra.Command{
+		Use:   "dns [action]",
+		Short: "Manage extra DNS records of environments",
+		Long: `Manage extra names in the DNS of the network of an environment, in its
+domain:
+
+  alias  another name of a VM, e.g. primary -> pg1
+  srv    a SRV record, e.g. _postgresql._tcp -> pg1:5432[:priority:weight]
+  txt    a TXT record, e.g. cluster -> "primary=pg1"
+
+Adding an alias that already exists moves it to the given VM, e.g. to
+follow a failover.
+
+TXT records are not managed by terraform, they are added to the network
+with libvirt and added back after each terraform apply on the environment.
+When adding them back fails, a warning is shown and they are missing from
+the DNS until the next successful change of the environment`,
+	}
+
+	addDNSCmd = &cobra.Command{
+		Use:   "add <env> alias|srv|txt <name> <value>",
+		Short: "Add a DNS record to an environment",
+		Run:   addDNS,
+	}
+
+	rmDNSCmd = &cobra.Command{
+		Use:   "rm <env> alias|srv|txt <name> [value]",
+		Short: "Remove DNS records from an environment",
+		Long: `Remove the DNS records of the given type and name from an environment, only
+the one with the given value when it is given`,
+		Run: rmDNS,
+	}
+
+	listDNSCmd = &cobra.Command{
+		Use:   "list <env>",
+		Short: "List the extra DNS records of an environment",
+		Run:   listDNS,
+	}
+)
+
+func addDNS(cmd *cobra.Command, args []string) {
+	if len(args) < 4 {
+		log.Fatalln("missing environment name, record type, name or value")
+	}
+
+	envName := envDNSArg(args)
+	record := terraform.DNSRecord{Type: args[1], Name: args[2], Value: args[3]}
+
+	tfConfigDir, conf := loadEnvConfig(envName)
+
+	if conf.Module.NetworkMode == "bridge" {
+		log.Fatalln("libvirt does not serve the DNS of bridged networks")
+	}
+
+	if err := conf.Module.CheckDNSRecord(record); err != nil {
+		log.Fatalln(err)
+	}
+
+	records := make([]terraform.DNSRecord, 0, len(conf.Module.DNSRecords)+1)
+	for _, r := range conf.Module.DNSRecords {
+		if r.Type == record.Type && r.Name == record.Name {
+			if r.Value == record.Value {
+				log.Fatalln("DNS record already exists in the environment")
+			}
+
+			// an alias has a single target
+			if r.Type == "alias" {
+				log.Printf("moving alias %s from %s to %s", r.Name, r.Value, record.Value)
+				continue
+			}
+		}
+		records = append(records, r)
+	}
+	conf.Module.DNSRecords = append(records, record)
+
+	if record.Type == "txt" {
+		h, err := hv.NewHypervisor(Uri)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer h.Close()
+
+		if err := hv.AddNetworkTXT(h, orDefault(conf.Module.NetworkName, "carcass"), txtName(conf.Module, record), record.Value); err != nil {
+			log.Fatalln(err)
+		}
+
+		if err := writeEnvConfig(tfConfigDir, conf); err != nil {
+			log.Fatalln(err)
+		}
+
+		return
+	}
+
+	if err := applyEnvConfig(tfConfigDir, conf); err != nil {
+		log.Fatalln(err)
+	}
+
+	// Force dnsmasq to re-read the addn-hosts file so that we can resolve
+	// the alias
+	if record.Type == "alias" {
+		if err := restartDnsmasq(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func rmDNS(cmd *cobra.Command, args []string) {
+	if len(args) < 3 {
+		log.Fatalln("missing environment name, record type or name")
+	}
+
+	envName := envDNSArg(args)
+	recType, name := args[1], args[2]
+	value := ""
+	if len(args) > 3 {
+		value = args[3]
+	}
+
+	tfConfigDir, conf := loadEnvConfig(envName)
+
+	records := make([]terraform.DNSRecord, 0, len(conf.Module.DNSRecords))
+	removed := make([]terraform.DNSRecord, 0)
+	for _, r := range conf.Module.DNSRecords {
+		if r.Type == recType && r.Name == name && (value == "" || r.Value == value) {
+			removed = append(removed, r)
+			continue
+		}
+		records = append(records, r)
+	}
+
+	if len(removed) == 0 {
+		log.Fatalln("DNS record not found in the terraform config of the environment")
+	}
+
+	conf.Module.DNSRecords = records
+
+	if recType == "txt" {
+		h, err := hv.NewHypervisor(Uri)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer h.Close()
+
+		for _, r := range removed {
+			if err := hv.RemoveNetworkTXT(h, orDefault(conf.Module.NetworkName, "carcass"), txtName(conf.Module, r), r.Value); err != nil {
+				log.Println(err)
+			}
+		}
+
+		if err := writeEnvConfig(tfConfigDir, conf); err != nil {
+			log.Fatalln(err)
+		}
+
+		return
+	}
+
+	if err := applyEnvConfig(tfConfigDir, conf); err != nil {
+		log.Fatalln(err)
+	}
+
+	if recType == "alias" {
+		if err := restartDnsmasq(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func listDNS(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatalln("missing environment name")
+	}
+
+	envName := envDNSArg(args)
+
+	_, conf := loadEnvConfig(envName)
+
+	records := make([]terraform.DNSRecord, len(conf.Module.DNSRecords))
+	copy(records, conf.Module.DNSRecords)
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Type != records[j].Type {
+			return records[i].Type < records[j].Type
+		}
+		return records[i].Name < records[j].Name
+	})
+
+	width := 0
+	for _, r := range records {
+		if len(r.Name) > width {
+			width = len(r.Name)
+		}
+	}
+
+	for _, r := range records {
+		fmt.Printf("%-5s  %-*s  %s\n", r.Type, width, r.Name, r.Value)
+	}
+}
+
+// txtName gives the fully qualified name of a TXT record
+func txtName(mod terraform.Module, r terraform.DNSRecord) string {
+	return fmt.Sprintf("%s.%s", r.Name, mod.Domain)
+}
+
+// envDNSArg validates the environment name given on the command line
+func envDNSArg(args []string) string {
+	envName := args[0]
+	if hasForbiddenChars(envName) || len(envName) == 0 {
+		log.Fatalln("invalid environment name")
+	}
+
+	return envName
+}
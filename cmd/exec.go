@@ -0,0 +1,224 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/orgrim/carcass/hv"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	execCmd.Flags().StringSliceVar(&execVms, "vm", nil, "run on these VMs, comma separated")
+	execCmd.Flags().StringVarP(&execGroup, "group", "g", "", "run on the VMs of this group")
+	execCmd.Flags().IntVarP(&execJobs, "jobs", "j", 4, "number of VMs to run the command on at once")
+	execCmd.Flags().BoolVar(&execCollect, "collect", false, "show the output of each VM at once, instead of prefixed lines")
+	execCmd.Flags().StringVarP(&sshIdentity, "identity", "i", "", "private key file, found from the public key of the environment by default")
+	rootCmd.AddCommand(execCmd)
+}
+
+var (
+	execCmd = &cobra.Command{
+		Use:   "exec <env> [options] -- <command...>",
+		Short: "Run a command on several VMs",
+		Long: `Run a command with SSH on all the VMs of an environment, or the ones given
+with --vm or the members of the group given with --group, in parallel. Both
+options cannot be used together. The exit status of each VM is shown at the end`,
+		Run: execVm,
+	}
+
+	execVms     []string
+	execGroup   string
+	execJobs    int
+	execCollect bool
+)
+
+type execResult struct {
+	name   string
+	status int
+	err    error
+	output bytes.Buffer
+}
+
+func execVm(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		log.Fatalln("missing environment name or command")
+	}
+
+	envName := args[0]
+	if hasForbiddenChars(envName) || len(envName) == 0 {
+		log.Fatalln("invalid environment name")
+	}
+
+	command := args[1:]
+	if dash := cmd.ArgsLenAtDash(); dash > 0 {
+		command = args[dash:]
+	}
+
+	if len(command) == 0 {
+		log.Fatalln("missing command")
+	}
+
+	if execJobs < 1 {
+		log.Fatalln("invalid number of jobs")
+	}
+
+	if len(execVms) > 0 && execGroup != "" {
+		log.Fatalln("--vm and --group cannot be used together")
+	}
+
+	h, err := hv.NewHypervisor(Uri)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	env, err := lookupEnvironment(&h, envName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	h.Close()
+
+	// select the VMs from the configuration
+	names := make([]string, 0)
+	if len(execVms) > 0 {
+		names = execVms
+	} else {
+		for name, m := range env.Infra.Config.Module.Machines {
+			if execGroup == "" {
+				names = append(names, name)
+				continue
+			}
+
+			for _, g := range m.Groups {
+				if g == execGroup {
+					names = append(names, name)
+					break
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		log.Fatalln("no VM selected")
+	}
+
+	key := sshKey(env)
+
+	var mu sync.Mutex
+	results := make([]*execResult, len(names))
+	sem := make(chan struct{}, execJobs)
+	var wg sync.WaitGroup
+
+	width := 0
+	for _, name := range names {
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+
+	for i, name := range names {
+		res := &execResult{name: name}
+		results[i] = res
+
+		target, err := sshTarget(env, name)
+		if err != nil {
+			res.err = err
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			sshArgs := append(sshOptions(key), "-o", "BatchMode=yes", target, "--")
+			sshArgs = append(sshArgs, command...)
+			c := exec.Command("ssh", sshArgs...)
+
+			if execCollect {
+				c.Stdout = &res.output
+				c.Stderr = &res.output
+				res.err = c.Run()
+			} else {
+				pr, pw := io.Pipe()
+				c.Stdout = pw
+				c.Stderr = pw
+
+				done := make(chan struct{})
+				go func() {
+					// read whole lines whatever their length, the
+					// last one may lack its newline
+					reader := bufio.NewReader(pr)
+					for {
+						line, err := reader.ReadString('\n')
+						if len(line) > 0 {
+							mu.Lock()
+							fmt.Printf("%-*s | %s\n", width, res.name, strings.TrimSuffix(line, "\n"))
+							mu.Unlock()
+						}
+
+						if err != nil {
+							break
+						}
+					}
+					close(done)
+				}()
+
+				res.err = c.Run()
+				pw.Close()
+				<-done
+			}
+
+			var exitErr *exec.ExitError
+			if errors.As(res.err, &exitErr) {
+				res.status = exitErr.ExitCode()
+				res.err = nil
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if execCollect {
+		for _, res := range results {
+			fmt.Printf("==> %s <==\n%s", res.name, res.output.String())
+			if res.output.Len() > 0 && !strings.HasSuffix(res.output.String(), "\n") {
+				fmt.Println()
+			}
+		}
+	}
+
+	fmt.Println()
+	failed := false
+	for _, res := range results {
+		switch {
+		case res.err != nil:
+			fmt.Printf("%-*s  error: %s\n", width, res.name, res.err)
+			failed = true
+		case res.status != 0:
+			fmt.Printf("%-*s  exit %d\n", width, res.name, res.status)
+			failed = true
+		default:
+			fmt.Printf("%-*s  ok\n", width, res.name)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,395 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/orgrim/carcass/hv"
+	"github.com/orgrim/carcass/infra"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	forwardCmd.Flags().StringVar(&forwardAddress, "address", "0.0.0.0", "Address of the host to listen on")
+	forwardCmd.Flags().BoolVar(&forwardDetach, "detach", false, "Run the proxy in the background")
+	forwardCmd.AddCommand(listForwardCmd)
+	forwardCmd.AddCommand(rmForwardCmd)
+	rootCmd.AddCommand(forwardCmd)
+}
+
+var (
+	forwardCmd = &cobra.Command{
+		Use:   "forward <env> <shortname> <hostport>:<guestport>",
+		Short: "Forward a port of the host to a VM",
+		Long: `Expose a TCP service of a VM on a port of the host, with a proxy run by
+carcass. The proxy runs in the foreground unless --detach is given, its
+output goes to a log file in the environment directory then. The proxy runs
+where carcass runs, so the hypervisor must be local: the addresses of the
+VMs are only reachable from its host`,
+		Run: forward,
+	}
+
+	listForwardCmd = &cobra.Command{
+		Use:   "list [env...]",
+		Short: "List port forwards",
+		Run:   listForwards,
+	}
+
+	rmForwardCmd = &cobra.Command{
+		Use:   "rm <env> <hostport>",
+		Short: "Stop a port forward",
+		Run:   rmForward,
+	}
+
+	forwardAddress string
+	forwardDetach  bool
+)
+
+func forward(cmd *cobra.Command, args []string) {
+	if len(args) < 3 {
+		log.Fatalln("missing environment name, vm name or ports")
+	}
+
+	envName, vmName := envVmArgs(args)
+
+	hostPort, guestPort, err := parsePortSpec(args[2])
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	dir, err := forwardsDir(envName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	h, err := hv.NewHypervisor(Uri)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if !h.IsLocal() {
+		h.Close()
+		log.Fatalln("cannot forward ports of a remote hypervisor, the VMs are only reachable from its host")
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		h.Close()
+		log.Fatalln("could not create forwards directory:", err)
+	}
+
+	statePath := filepath.Join(dir, fmt.Sprintf("%d.json", hostPort))
+	if f, err := infra.ReadForward(statePath); err == nil && forwardAlive(f) {
+		h.Close()
+		log.Fatalf("port %d is already forwarded: %s", hostPort, f)
+	}
+
+	if forwardDetach {
+		h.Close()
+		detachForward(args, statePath, filepath.Join(dir, fmt.Sprintf("%d.log", hostPort)))
+		return
+	}
+
+	env, err := lookupEnvironment(&h, envName)
+	if err != nil {
+		h.Close()
+		log.Fatalln(err)
+	}
+
+	ip := env.Infra.MachineAddress(fmt.Sprintf("%s.%s", vmName, env.Domain))
+	h.Close()
+	if ip == nil {
+		log.Fatalf("could not find the IP address of %s", vmName)
+	}
+
+	f := infra.Forward{
+		Env:    envName,
+		Vm:     vmName,
+		Listen: net.JoinHostPort(forwardAddress, strconv.Itoa(hostPort)),
+		Target: net.JoinHostPort(ip.String(), strconv.Itoa(guestPort)),
+		Pid:    os.Getpid(),
+	}
+
+	// the state is only saved once the port is ours, a detached proxy
+	// reports its success with it
+	l, err := net.Listen("tcp", f.Listen)
+	if err != nil {
+		log.Fatalf("could not listen on %s: %s", f.Listen, err)
+	}
+
+	if err := f.Save(statePath); err != nil {
+		l.Close()
+		log.Fatalln(err)
+	}
+	defer os.Remove(statePath)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Printf("forwarding %s", f)
+	if err := f.ServeListener(ctx, l); err != nil {
+		os.Remove(statePath)
+		log.Fatalln(err)
+	}
+}
+
+// detachForwardTimeout is how long the detached proxy has to start listening
+const detachForwardTimeout = 10 * time.Second
+
+// detachForward runs the same forward command in a new session, with its
+// output sent to the log file. It waits for the proxy to save its state,
+// which it does once it listens.
+func detachForward(args []string, statePath string, logPath string) {
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatalln("could not find the carcass executable:", err)
+	}
+
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatalln("could not open log file:", err)
+	}
+	defer logFile.Close()
+
+	cargs := []string{"forward", "--connect", Uri, "--data-dir", DataDir, "--address", forwardAddress}
+	cargs = append(cargs, args...)
+
+	c := exec.Command(self, cargs...)
+	c.Stdout = logFile
+	c.Stderr = logFile
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := c.Start(); err != nil {
+		log.Fatalln("could not start the proxy:", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- c.Wait()
+	}()
+
+	deadline := time.After(detachForwardTimeout)
+	for {
+		if f, err := infra.ReadForward(statePath); err == nil && f.Pid == c.Process.Pid {
+			break
+		}
+
+		select {
+		case err := <-exited:
+			log.Fatalf("proxy failed to start (%v), see %s", err, logPath)
+		case <-deadline:
+			c.Process.Kill()
+			log.Fatalf("proxy did not start in %s, see %s", detachForwardTimeout, logPath)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	log.Printf("proxy running in the background with pid %d, logs in %s", c.Process.Pid, logPath)
+}
+
+func listForwards(cmd *cobra.Command, args []string) {
+	envs := args
+	if len(envs) == 0 {
+		dir, err := environmentDir(DataDir, "")
+		if err != nil {
+			log.Fatalln("invalid data directory:", err)
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Fatalln(err)
+		}
+
+		for _, e := range entries {
+			if e.IsDir() {
+				envs = append(envs, e.Name())
+			}
+		}
+	}
+
+	for _, e := range envs {
+		dir, err := forwardsDir(e)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		states, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+		for _, path := range states {
+			f, err := infra.ReadForward(path)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+
+			// the proxy died without cleaning up
+			if !forwardAlive(f) {
+				os.Remove(path)
+				continue
+			}
+
+			fmt.Printf("%s  pid %d\n", f, f.Pid)
+		}
+	}
+}
+
+func rmForward(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		log.Fatalln("missing environment name or host port")
+	}
+
+	hostPort, err := strconv.Atoi(args[1])
+	if err != nil {
+		log.Fatalln("invalid host port:", args[1])
+	}
+
+	dir, err := forwardsDir(args[0])
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	statePath := filepath.Join(dir, fmt.Sprintf("%d.json", hostPort))
+	f, err := infra.ReadForward(statePath)
+	if err != nil {
+		log.Fatalf("port %d is not forwarded in %s", hostPort, args[0])
+	}
+
+	if err := stopForward(statePath, f); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// stopForward stops the proxy of a forward and removes its state file
+func stopForward(statePath string, f infra.Forward) error {
+	if forwardAlive(f) {
+		if err := syscall.Kill(f.Pid, syscall.SIGTERM); err != nil {
+			return fmt.Errorf("could not stop proxy with pid %d: %w", f.Pid, err)
+		}
+	}
+
+	// the proxy removes its state file when it exits, do it in case it
+	// was already dead
+	os.Remove(statePath)
+	log.Printf("stopped forward %s", f)
+
+	return nil
+}
+
+// stopVmForwards stops the forwards to a VM of the environment, errors are
+// only reported
+func stopVmForwards(envName string, vmName string) {
+	dir, err := forwardsDir(envName)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	states, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	for _, path := range states {
+		f, err := infra.ReadForward(path)
+		if err != nil || f.Vm != vmName {
+			continue
+		}
+
+		if err := stopForward(path, f); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// parsePortSpec reads a pair of ports in the form HOSTPORT:GUESTPORT
+func parsePortSpec(spec string) (int, int, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid ports %s, expected HOSTPORT:GUESTPORT", spec)
+	}
+
+	ports := make([]int, 2)
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n <= 0 || n > 65535 {
+			return 0, 0, fmt.Errorf("invalid port %s in %s", p, spec)
+		}
+		ports[i] = n
+	}
+
+	return ports[0], ports[1], nil
+}
+
+// forwardsDir gives the directory where the state of the forwards of the
+// environment is kept, it may not exist yet
+func forwardsDir(envName string) (string, error) {
+	if hasForbiddenChars(envName) || len(envName) == 0 {
+		return "", fmt.Errorf("invalid environment name")
+	}
+
+	envPath, err := environmentDir(DataDir, envName)
+	if err != nil {
+		return "", fmt.Errorf("invalid data directory: %w", err)
+	}
+
+	if _, err := os.Stat(envPath); errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("environment %s does not exist", envName)
+	}
+
+	return filepath.Join(envPath, "forwards"), nil
+}
+
+// forwardAlive tells if the pid of the state of a forward is still the one of
+// its proxy. The proxy may have died without cleaning up and its pid reused
+// by another process, so the command line of the process is checked.
+func forwardAlive(f infra.Forward) bool {
+	if f.Pid <= 0 {
+		return false
+	}
+
+	_, port, err := net.SplitHostPort(f.Listen)
+	if err != nil {
+		return false
+	}
+
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", f.Pid))
+	if err != nil {
+		return false
+	}
+
+	return isForwardCmdline(cmdline, f.Env, port)
+}
+
+// isForwardCmdline tells if the NUL separated arguments of a process are the
+// ones of a carcass forward command of the host port in the environment
+func isForwardCmdline(cmdline []byte, env string, port string) bool {
+	args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+	if len(args) < 2 {
+		return false
+	}
+
+	// the positional arguments are the command, the environment, the vm
+	// and the ports, flags may come anywhere
+	pos := make([]string, 0, 4)
+	for i := 1; i < len(args); i++ {
+		switch a := args[i]; {
+		case a == "--connect" || a == "-c" || a == "--data-dir" || a == "-d" || a == "--address":
+			i++
+		case strings.HasPrefix(a, "-"):
+		default:
+			pos = append(pos, a)
+		}
+	}
+
+	return len(pos) >= 4 && pos[0] == "forward" && pos[1] == env && strings.HasPrefix(pos[3], port+":")
+}
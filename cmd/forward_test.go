@@ -0,0 +1,67 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParsePortSpec(t *testing.T) {
+	var tests = []struct {
+		input string
+		host  int
+		guest int
+		fail  bool
+	}{
+		{"8080:80", 8080, 80, false},
+		{"5432:5432", 5432, 5432, false},
+		{"8080", 0, 0, true},
+		{"8080:http", 0, 0, true},
+		{"0:80", 0, 0, true},
+		{"8080:70000", 0, 0, true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			host, guest, err := parsePortSpec(st.input)
+			if (err != nil) != st.fail {
+				t.Errorf("got: %v, want failure %v", err, st.fail)
+			}
+			if host != st.host || guest != st.guest {
+				t.Errorf("got: %v:%v, want %v:%v", host, guest, st.host, st.guest)
+			}
+		})
+	}
+}
+
+func TestIsForwardCmdline(t *testing.T) {
+	var tests = []struct {
+		cmdline string
+		env     string
+		port    string
+		want    bool
+	}{
+		{"carcass\x00forward\x00env\x00vm\x008080:80\x00", "env", "8080", true},
+		{"/usr/bin/carcass\x00forward\x00--connect\x00qemu:///system\x00--data-dir\x00/data\x00--address\x000.0.0.0\x00env\x00vm\x008080:80\x00", "env", "8080", true},
+		{"carcass\x00-c\x00qemu:///system\x00forward\x00env\x00vm\x00--detach\x008080:80\x00", "env", "8080", true},
+		{"carcass\x00forward\x00other\x00vm\x008080:80\x00", "env", "8080", false},
+		{"carcass\x00forward\x00--address\x00env\x00other\x00vm\x008080:80\x00", "env", "8080", false},
+		{"carcass\x00forward\x00env\x00vm\x008080:80\x00", "env", "80", false},
+		{"carcass\x00forward\x00env\x00vm\x0018080:80\x00", "env", "8080", false},
+		{"carcass\x00ssh\x00env\x00vm\x00", "env", "8080", false},
+		{"bash\x00", "env", "8080", false},
+		{"", "env", "8080", false},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got := isForwardCmdline([]byte(st.cmdline), st.env, st.port)
+			if got != st.want {
+				t.Errorf("got: %v, want %v", got, st.want)
+			}
+		})
+	}
+}
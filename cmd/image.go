@@ -10,6 +10,7 @@ import (
 
 	"github.com/orgrim/carcass/hv"
 	"github.com/orgrim/carcass/infra"
+	"github.com/orgrim/carcass/terraform"
 	"github.com/schollz/progressbar/v3"
 	"github.com/spf13/cobra"
 )
@@ -38,7 +39,8 @@ var (
 		Run:   rmImage,
 	}
 
-	poolName string
+	poolName      string
+	imageFirmware string
 )
 
 func init() {
@@ -46,6 +48,7 @@ func init() {
 	imageCmd.AddCommand(listImageCmd)
 
 	addImageCmd.Flags().StringVarP(&poolName, "storage-pool", "p", "default", "operate on this storage pool")
+	addImageCmd.Flags().StringVar(&imageFirmware, "firmware", "bios", "firmware needed to boot the image: bios, uefi or uefi-secure")
 	imageCmd.AddCommand(addImageCmd)
 
 	rmImageCmd.Flags().StringVarP(&poolName, "storage-pool", "p", "default", "operate on this storage pool")
@@ -86,6 +89,10 @@ func addImage(cmd *cobra.Command, args []string) {
 	name := args[0]
 	rawurl := args[1]
 
+	if err := terraform.CheckFirmware(imageFirmware); err != nil {
+		log.Fatalln(err)
+	}
+
 	h, err := hv.NewHypervisor(Uri)
 	if err != nil {
 		log.Fatalln(err)
@@ -107,6 +114,7 @@ func addImage(cmd *cobra.Command, args []string) {
 		log.Fatalln("could not add image:", err)
 	}
 	image.Source = rawurl
+	image.Firmware = imageFirmware
 
 	dataDir, err := expandDataDir(DataDir)
 	if err != nil {
@@ -118,6 +126,11 @@ func addImage(cmd *cobra.Command, args []string) {
 	if err != nil {
 		log.Println("warning:", err)
 	}
+
+	err = image.AddFirmwareMap(dataDir)
+	if err != nil {
+		log.Println("warning:", err)
+	}
 }
 
 func rmImage(cmd *cobra.Command, args []string) {
@@ -155,6 +168,11 @@ func rmImage(cmd *cobra.Command, args []string) {
 		log.Println("warning:", err)
 	}
 
+	err = image.RemoveFirmwareMap(dataDir)
+	if err != nil {
+		log.Println("warning:", err)
+	}
+
 	err = image.Drop(&h)
 	if err != nil {
 		log.Fatalln("could not remove image:", err)
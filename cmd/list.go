@@ -41,6 +41,14 @@ func list(cmd *cobra.Command, args []string) {
 			log.Fatalln(err)
 		}
 		width := 0
+		envNets := nets[:0]
+		for _, net := range nets {
+			if !isExtraNetwork(net.Name) {
+				envNets = append(envNets, net)
+			}
+		}
+		nets = envNets
+
 		for _, net := range nets {
 			if len(net.Name) > width {
 				width = len(net.Name)
@@ -59,7 +67,7 @@ func list(cmd *cobra.Command, args []string) {
 					fmt.Printf(" ")
 				}
 
-				fmt.Printf("  %s\n", net.Address)
+				fmt.Printf("  %-18s  %-8s  %s\n", net.Address, net.Mode(), net.Address6)
 			}
 		}
 	}
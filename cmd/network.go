@@ -0,0 +1,166 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+
+	"github.com/orgrim/carcass/terraform"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	networkCmd.AddCommand(addNetworkCmd)
+	networkCmd.AddCommand(rmNetworkCmd)
+	networkCmd.AddCommand(listNetworkCmd)
+	rootCmd.AddCommand(networkCmd)
+}
+
+var (
+	networkCmd = &cobra.Command{
+		Use:   "network [action]",
+		Short: "Manage extra networks of environments",
+		Long: `Manage isolated extra networks of an environment, e.g. for replication or
+storage traffic. VMs are attached to them with vm add --nic`,
+	}
+
+	addNetworkCmd = &cobra.Command{
+		Use:   "add <env> <name> <cidr>",
+		Short: "Add an extra network to an environment",
+		Run:   addNetwork,
+	}
+
+	rmNetworkCmd = &cobra.Command{
+		Use:   "rm <env> <name>",
+		Short: "Remove an extra network from an environment",
+		Run:   rmNetwork,
+	}
+
+	listNetworkCmd = &cobra.Command{
+		Use:   "list <env>",
+		Short: "List the networks of an environment",
+		Run:   listNetwork,
+	}
+)
+
+func addNetwork(cmd *cobra.Command, args []string) {
+	if len(args) < 3 {
+		log.Fatalln("missing environment name, network name or cidr")
+	}
+
+	envName, netName := envNetworkArgs(args)
+
+	_, ipnet, err := net.ParseCIDR(args[2])
+	if err != nil {
+		log.Fatalln("invalid network address:", err)
+	}
+
+	tfConfigDir, conf := loadEnvConfig(envName)
+
+	if conf.Module.Networks == nil {
+		conf.Module.Networks = make(map[string]terraform.Network)
+	}
+
+	if _, ok := conf.Module.Networks[netName]; ok {
+		log.Fatalln("network already exists in the environment")
+	}
+
+	if err := conf.Module.CheckNetwork(ipnet.String()); err != nil {
+		log.Fatalln(err)
+	}
+
+	conf.Module.Networks[netName] = terraform.Network{CIDR: ipnet.String()}
+
+	if err := applyEnvConfig(tfConfigDir, conf); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func rmNetwork(cmd *cobra.Command, args []string) {
+	envName, netName := envNetworkArgs(args)
+
+	tfConfigDir, conf := loadEnvConfig(envName)
+
+	if _, ok := conf.Module.Networks[netName]; !ok {
+		log.Fatalln("network not found in the terraform config of the environment")
+	}
+
+	for name, m := range conf.Module.Machines {
+		for _, nic := range m.Nics {
+			if nic.Network == netName {
+				log.Fatalf("network is used by %s", name)
+			}
+		}
+	}
+
+	delete(conf.Module.Networks, netName)
+
+	if err := applyEnvConfig(tfConfigDir, conf); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func listNetwork(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatalln("missing environment name")
+	}
+
+	envName := args[0]
+	if hasForbiddenChars(envName) || len(envName) == 0 {
+		log.Fatalln("invalid environment name")
+	}
+
+	_, conf := loadEnvConfig(envName)
+
+	names := make([]string, 0, len(conf.Module.Networks))
+	width := len(conf.Module.NetworkName)
+	for name := range conf.Module.Networks {
+		names = append(names, name)
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	sort.Strings(names)
+
+	fmt.Printf("%-*s  %s", width, conf.Module.NetworkName, conf.Module.NetworkCIDR)
+	if conf.Module.NetworkCIDR6 != "" {
+		fmt.Printf("  %s", conf.Module.NetworkCIDR6)
+	}
+	fmt.Println()
+	for _, name := range names {
+		fmt.Printf("%-*s  %s\n", width, name, conf.Module.Networks[name].CIDR)
+
+		for vm, m := range conf.Module.Machines {
+			for _, nic := range m.Nics {
+				if nic.Network == name {
+					fmt.Printf("  - %s  %s\n", vm, nic.IPAddress)
+				}
+			}
+		}
+	}
+}
+
+// envNetworkArgs validates the environment and network names given on the
+// command line
+func envNetworkArgs(args []string) (string, string) {
+	if len(args) < 2 {
+		log.Fatalln("missing environment name or network name")
+	}
+
+	envName := args[0]
+	if hasForbiddenChars(envName) || len(envName) == 0 {
+		log.Fatalln("invalid environment name")
+	}
+
+	netName := args[1]
+	if hasForbiddenChars(netName) || len(netName) == 0 {
+		log.Fatalln("invalid network name")
+	}
+
+	return envName, netName
+}
@@ -0,0 +1,237 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/orgrim/carcass/environment"
+	"github.com/orgrim/carcass/hv"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	sshCmd.Flags().StringVarP(&sshIdentity, "identity", "i", "", "private key file, found from the public key of the environment by default")
+	sshCmd.Flags().SetInterspersed(false)
+	rootCmd.AddCommand(sshCmd)
+
+	scpCmd.Flags().StringVarP(&sshIdentity, "identity", "i", "", "private key file, found from the public key of the environment by default")
+	scpCmd.Flags().BoolVarP(&scpRecursive, "recursive", "r", false, "copy directories recursively")
+	rootCmd.AddCommand(scpCmd)
+}
+
+var (
+	sshCmd = &cobra.Command{
+		Use:   "ssh <env> <vm> [command...]",
+		Short: "Connect to a VM with SSH",
+		Long: `Connect to a VM with SSH or run a command on it. The IP address, the user and
+the key are found from the environment, DNS resolution on the host is not
+needed`,
+		Run: sshVm,
+	}
+
+	scpCmd = &cobra.Command{
+		Use:   "scp <env> <src>... <dst>",
+		Short: "Copy files to and from VMs",
+		Long: `Copy files between the host and the VMs of an environment with scp. Remote
+paths are given as <vm>:<path>`,
+		Run: scpVm,
+	}
+
+	sshIdentity  string
+	scpRecursive bool
+)
+
+func sshVm(cmd *cobra.Command, args []string) {
+	envName, vmName := envVmArgs(args)
+
+	h, err := hv.NewHypervisor(Uri)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	env, err := lookupEnvironment(&h, envName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	target, err := sshTarget(env, vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	key := sshKey(env)
+	h.Close()
+
+	sshArgs := append(sshOptions(key), target)
+	sshArgs = append(sshArgs, args[2:]...)
+
+	runSsh("ssh", sshArgs)
+}
+
+func scpVm(cmd *cobra.Command, args []string) {
+	if len(args) < 3 {
+		log.Fatalln("missing environment name, source or destination")
+	}
+
+	envName := args[0]
+	if hasForbiddenChars(envName) || len(envName) == 0 {
+		log.Fatalln("invalid environment name")
+	}
+
+	h, err := hv.NewHypervisor(Uri)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	env, err := lookupEnvironment(&h, envName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// replace the name of the VMs with the user and IP address
+	paths := make([]string, 0, len(args)-1)
+	for _, p := range args[1:] {
+		parts := strings.SplitN(p, ":", 2)
+		if len(parts) == 1 || strings.Contains(parts[0], "/") {
+			paths = append(paths, p)
+			continue
+		}
+
+		target, err := sshTarget(env, parts[0])
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		paths = append(paths, fmt.Sprintf("%s:%s", target, parts[1]))
+	}
+
+	key := sshKey(env)
+	h.Close()
+
+	scpArgs := sshOptions(key)
+	if scpRecursive {
+		scpArgs = append(scpArgs, "-r")
+	}
+	scpArgs = append(scpArgs, paths...)
+
+	runSsh("scp", scpArgs)
+}
+
+// sshTarget gives the user@ip destination of a VM, the IP address is found in
+// the network definition of the environment or its configuration
+func sshTarget(env *environment.Environment, vmName string) (string, error) {
+	if hasForbiddenChars(vmName) || len(vmName) == 0 {
+		return "", fmt.Errorf("invalid vm name: %s", vmName)
+	}
+
+	ip := env.Infra.MachineAddress(fmt.Sprintf("%s.%s", vmName, env.Domain))
+	if ip == nil {
+		return "", fmt.Errorf("could not find the IP address of %s", vmName)
+	}
+
+	return fmt.Sprintf("%s@%s", sshUser(env), ip), nil
+}
+
+// sshUser finds the user created in the VMs by cloud-init
+func sshUser(env *environment.Environment) string {
+	if env.Infra.Config.Module.Username != "" {
+		return env.Infra.Config.Module.Username
+	}
+
+	if userConfig, err := loadConfig(); err == nil && userConfig.Username != "" {
+		return userConfig.Username
+	}
+
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+
+	return "carcass"
+}
+
+// sshKey finds the private key to connect to the VMs: the one given on the
+// command line or in the user configuration, or the one matching the public
+// key of the environment in ~/.ssh. An empty path lets ssh choose.
+func sshKey(env *environment.Environment) string {
+	if sshIdentity != "" {
+		return sshIdentity
+	}
+
+	if userConfig, err := loadConfig(); err == nil && userConfig.SshKey != "" {
+		key, err := expandDataDir(userConfig.SshKey)
+		if err == nil {
+			return key
+		}
+	}
+
+	pubKey := strings.TrimSpace(env.Infra.Config.Module.SshPubKey)
+	if pubKey == "" {
+		return ""
+	}
+
+	sshDir, err := expandDataDir("~/.ssh")
+	if err != nil {
+		return ""
+	}
+
+	pubFiles, _ := filepath.Glob(filepath.Join(sshDir, "*.pub"))
+	for _, f := range pubFiles {
+		contents, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+
+		// compare the type and the key, ignoring the comment
+		fields := strings.Fields(string(contents))
+		want := strings.Fields(pubKey)
+		if len(fields) >= 2 && len(want) >= 2 && fields[0] == want[0] && fields[1] == want[1] {
+			return strings.TrimSuffix(f, ".pub")
+		}
+	}
+
+	return ""
+}
+
+// sshOptions gives the common options of ssh and scp. The host keys of VMs
+// change every time they are recreated, they are not checked.
+func sshOptions(key string) []string {
+	opts := []string{
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "LogLevel=ERROR",
+	}
+
+	if key != "" {
+		opts = append(opts, "-i", key)
+	}
+
+	return opts
+}
+
+// runSsh runs ssh or scp attached to the terminal and exits with its exit
+// code
+func runSsh(prog string, args []string) {
+	c := exec.Command(prog, args...)
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+
+	err := c.Run()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitCode())
+		}
+		log.Fatalln(err)
+	}
+}
@@ -5,17 +5,24 @@
 package cmd
 
 import (
+	"fmt"
 	"github.com/orgrim/carcass/environment"
 	"github.com/orgrim/carcass/hv"
 	"github.com/spf13/cobra"
 	"log"
+	"os"
+	"time"
 )
 
 func init() {
+	startCmd.Flags().DurationVarP(&startTimeout, "timeout", "t", 5*time.Minute, "time to wait for each boot group to be reachable")
 	rootCmd.AddCommand(startCmd)
 
 	stopCmd.Flags().BoolVarP(&stopAll, "all", "a", false, "stop all environments")
 	stopCmd.Flags().BoolVarP(&forceStop, "force", "f", false, "send shutdown request even if domain is not active")
+	stopCmd.Flags().BoolVarP(&stopWait, "wait", "w", false, "wait for the VMs to be down and report their state")
+	stopCmd.Flags().DurationVarP(&stopTimeout, "timeout", "t", 120*time.Second, "time to wait for the VMs to be down, with --wait")
+	stopCmd.Flags().BoolVar(&stopForceAfter, "force-after", false, "destroy the VMs still running after the timeout, with --wait")
 	rootCmd.AddCommand(stopCmd)
 }
 
@@ -23,19 +30,25 @@ var (
 	startCmd = &cobra.Command{
 		Use:   "start env [env...]",
 		Short: "Start environment",
-		Long:  "Start all VM of the environment",
-		Run:   start,
+		Long: `Start all VM of the environment, by boot group. VMs of a group are started
+when all VMs of the previous group are reachable with SSH`,
+		Run: start,
 	}
 
 	stopCmd = &cobra.Command{
 		Use:   "stop env [env...]",
 		Short: "Stop environment",
-		Long:  "Stop all VM of the environment",
-		Run:   stop,
+		Long: `Stop all VM of the environment. With --wait, the command exits with an error
+when some VM are still running after the timeout`,
+		Run: stop,
 	}
 
-	stopAll   bool
-	forceStop bool
+	stopAll        bool
+	forceStop      bool
+	stopWait       bool
+	stopTimeout    time.Duration
+	stopForceAfter bool
+	startTimeout   time.Duration
 )
 
 func start(cmd *cobra.Command, args []string) {
@@ -49,13 +62,24 @@ func start(cmd *cobra.Command, args []string) {
 	}
 	defer h.Close()
 
+	failed := false
 	for _, e := range args {
-		env, err := environment.Lookup(&h, e)
+		env, err := lookupEnvironment(&h, e)
 		if err != nil {
 			log.Println(err)
+			failed = true
 			continue
 		}
-		env.Start()
+
+		if err := env.Start(startTimeout); err != nil {
+			log.Printf("environment %s: %s", e, err)
+			failed = true
+		}
+	}
+
+	if failed {
+		h.Close()
+		os.Exit(1)
 	}
 }
 
@@ -73,7 +97,9 @@ func stop(cmd *cobra.Command, args []string) {
 			log.Fatalln(err)
 		}
 		for _, net := range nets {
-			envs = append(envs, net.Name)
+			if !isExtraNetwork(net.Name) {
+				envs = append(envs, net.Name)
+			}
 		}
 	} else {
 		envs = args
@@ -83,12 +109,30 @@ func stop(cmd *cobra.Command, args []string) {
 		log.Fatalln("missing environment")
 	}
 
+	failed := false
 	for _, e := range envs {
 		env, err := environment.Lookup(&h, e)
 		if err != nil {
 			log.Println(err)
+			failed = true
+			continue
+		}
+
+		if !stopWait {
+			env.Stop(forceStop)
 			continue
 		}
-		env.Stop(forceStop)
+
+		for _, s := range env.StopWait(stopTimeout, stopForceAfter) {
+			fmt.Println(s)
+			if !s.Stopped() {
+				failed = true
+			}
+		}
+	}
+
+	if stopWait && failed {
+		h.Close()
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,214 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/orgrim/carcass/hv"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	topCmd.Flags().DurationVar(&topInterval, "interval", 2*time.Second, "delay between refreshes")
+	topCmd.Flags().BoolVar(&topOnce, "once", false, "show the usage once and exit")
+	rootCmd.AddCommand(topCmd)
+}
+
+var (
+	topCmd = &cobra.Command{
+		Use:   "top [env...]",
+		Short: "Show the resource usage of the VMs",
+		Long: `Show the CPU, memory, disk I/O and network throughput of the running VMs,
+grouped by environment. A CPU usage of 100% means one host CPU is fully used`,
+		Run: top,
+	}
+
+	topInterval time.Duration
+	topOnce     bool
+)
+
+// A vmUsage holds the resource usage of a VM between two samples of its
+// statistics
+type vmUsage struct {
+	Env     string
+	Name    string
+	Vcpus   int
+	Cpu     float64 // percent of one host CPU
+	Memory  int64
+	MemUsed int64
+	Read    float64 // bytes per second
+	Write   float64
+	Rx      float64
+	Tx      float64
+}
+
+func top(cmd *cobra.Command, args []string) {
+	h, err := hv.NewHypervisor(Uri)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer h.Close()
+
+	// VM and environment names may contain dots, the environment of a VM
+	// is found by matching the suffix of its domain name
+	nets, err := hv.ListNetworks(h)
+	if err != nil {
+		h.Close()
+		log.Fatalln(err)
+	}
+
+	known := make([]string, 0, len(nets))
+	for _, net := range nets {
+		if !isExtraNetwork(net.Name) {
+			known = append(known, net.Name)
+		}
+	}
+
+	prev, err := hv.GetDomainStats(h)
+	if err != nil {
+		h.Close()
+		log.Fatalln(err)
+	}
+
+	for {
+		time.Sleep(topInterval)
+
+		cur, err := hv.GetDomainStats(h)
+		if err != nil {
+			h.Close()
+			log.Fatalln(err)
+		}
+
+		usage := computeUsage(prev, cur, known, args)
+		prev = cur
+
+		if topOnce {
+			fmt.Print(formatUsage(usage))
+			return
+		}
+
+		// clear the screen and move the cursor to the top left corner
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("carcass top - %s - every %s\n\n", time.Now().Format("15:04:05"), topInterval)
+		fmt.Print(formatUsage(usage))
+	}
+}
+
+// computeUsage compares two samples of statistics of the domains and gives
+// the usage of the VMs found in both, sorted by environment and name. The
+// known environments are used to split the domain names. When envs is not
+// empty, only the VMs of those environments are kept.
+func computeUsage(prev []hv.DomainStats, cur []hv.DomainStats, known []string, envs []string) []vmUsage {
+	wanted := make(map[string]bool, len(envs))
+	for _, e := range envs {
+		wanted[e] = true
+	}
+
+	before := make(map[string]hv.DomainStats, len(prev))
+	for _, s := range prev {
+		before[s.Name] = s
+	}
+
+	usage := make([]vmUsage, 0, len(cur))
+	for _, s := range cur {
+		// counters restart from zero when the VM is restarted
+		p, ok := before[s.Name]
+		if !ok || s.CpuTime < p.CpuTime || s.ReadBytes < p.ReadBytes || s.WriteBytes < p.WriteBytes ||
+			s.RxBytes < p.RxBytes || s.TxBytes < p.TxBytes {
+			continue
+		}
+
+		elapsed := s.Time.Sub(p.Time).Seconds()
+		if elapsed <= 0 {
+			continue
+		}
+
+		name, env := splitDomainName(s.Name, known)
+
+		if len(wanted) > 0 && !wanted[env] {
+			continue
+		}
+
+		usage = append(usage, vmUsage{
+			Env:     env,
+			Name:    name,
+			Vcpus:   s.Vcpus,
+			Cpu:     float64(s.CpuTime-p.CpuTime) / 1e9 / elapsed * 100,
+			Memory:  s.Memory,
+			MemUsed: s.MemUsed,
+			Read:    float64(s.ReadBytes-p.ReadBytes) / elapsed,
+			Write:   float64(s.WriteBytes-p.WriteBytes) / elapsed,
+			Rx:      float64(s.RxBytes-p.RxBytes) / elapsed,
+			Tx:      float64(s.TxBytes-p.TxBytes) / elapsed,
+		})
+	}
+
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Env != usage[j].Env {
+			return usage[i].Env < usage[j].Env
+		}
+		return usage[i].Name < usage[j].Name
+	})
+
+	return usage
+}
+
+// splitDomainName gives the name of the VM and its environment from the name
+// of a domain, using the longest known environment matching the end of the
+// name. Without a match, the name is split at its last dot.
+func splitDomainName(domName string, known []string) (string, string) {
+	name, env := domName, ""
+	for _, e := range known {
+		if len(e) > len(env) && len(domName) > len(e)+1 && strings.HasSuffix(domName, "."+e) {
+			name, env = domName[:len(domName)-len(e)-1], e
+		}
+	}
+
+	if env != "" {
+		return name, env
+	}
+
+	if i := strings.LastIndex(domName, "."); i > 0 {
+		return domName[:i], domName[i+1:]
+	}
+
+	return domName, ""
+}
+
+func formatUsage(usage []vmUsage) string {
+	s := fmt.Sprintf("%-16s %5s %7s %21s %12s %12s %12s %12s\n", "VM", "VCPU", "CPU%", "MEM USED/TOTAL", "DISK RD/s", "DISK WR/s", "NET RX/s", "NET TX/s")
+
+	env := ""
+	first := true
+	var cpu float64
+	for _, u := range usage {
+		if first || u.Env != env {
+			if !first {
+				s += fmt.Sprintf("%-16s %5s %6.1f%%\n", "  total", "", cpu)
+			}
+			s += fmt.Sprintf("[%s]\n", u.Env)
+			env = u.Env
+			first = false
+			cpu = 0
+		}
+
+		cpu += u.Cpu
+		s += fmt.Sprintf("%-16s %5d %6.1f%% %21s %12s %12s %12s %12s\n", "  "+u.Name, u.Vcpus, u.Cpu,
+			hv.SizePretty(u.MemUsed)+"/"+hv.SizePretty(u.Memory),
+			hv.SizePretty(int64(u.Read)), hv.SizePretty(int64(u.Write)),
+			hv.SizePretty(int64(u.Rx)), hv.SizePretty(int64(u.Tx)))
+	}
+
+	if !first {
+		s += fmt.Sprintf("%-16s %5s %6.1f%%\n", "  total", "", cpu)
+	}
+
+	return s
+}
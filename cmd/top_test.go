@@ -0,0 +1,90 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/orgrim/carcass/hv"
+)
+
+func TestComputeUsage(t *testing.T) {
+	t0 := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	t1 := t0.Add(2 * time.Second)
+
+	prev := []hv.DomainStats{
+		{Name: "pg1.lab", Time: t0, CpuTime: 1e9, ReadBytes: 1000, RxBytes: 0},
+		{Name: "web.demo", Time: t0, CpuTime: 0},
+		{Name: "gone.lab", Time: t0},
+		{Name: "web.a.b.lab", Time: t0},
+	}
+	cur := []hv.DomainStats{
+		{Name: "pg1.lab", Time: t1, Vcpus: 2, CpuTime: 2e9, ReadBytes: 5000, RxBytes: 2048},
+		{Name: "web.demo", Time: t1, CpuTime: 4e9},
+		{Name: "new.lab", Time: t1},
+		{Name: "web.a.b.lab", Time: t1},
+	}
+
+	var tests = []struct {
+		envs []string
+		want []vmUsage
+	}{
+		{
+			nil,
+			[]vmUsage{
+				{Env: "b.lab", Name: "web.a"},
+				{Env: "demo", Name: "web", Cpu: 200},
+				{Env: "lab", Name: "pg1", Vcpus: 2, Cpu: 50, Read: 2000, Rx: 1024},
+			},
+		},
+		{
+			[]string{"lab"},
+			[]vmUsage{
+				{Env: "lab", Name: "pg1", Vcpus: 2, Cpu: 50, Read: 2000, Rx: 1024},
+			},
+		},
+		{
+			[]string{"other"},
+			[]vmUsage{},
+		},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got := computeUsage(prev, cur, []string{"lab", "demo", "b.lab"}, st.envs)
+			if fmt.Sprintf("%v", got) != fmt.Sprintf("%v", st.want) {
+				t.Errorf("got: %v, want %v", got, st.want)
+			}
+		})
+	}
+}
+
+func TestSplitDomainName(t *testing.T) {
+	known := []string{"lab", "a.lab", "demo"}
+
+	var tests = []struct {
+		input string
+		name  string
+		env   string
+	}{
+		{"pg1.lab", "pg1", "lab"},
+		{"web.a.lab", "web", "a.lab"},
+		{"deb.local.demo", "deb.local", "demo"},
+		{"vm.other", "vm", "other"},
+		{"vm.x.other", "vm.x", "other"},
+		{"lab", "lab", ""},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			name, env := splitDomainName(st.input, known)
+			if name != st.name || env != st.env {
+				t.Errorf("got: %s %s, want %s %s", name, env, st.name, st.env)
+			}
+		})
+	}
+}
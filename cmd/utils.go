@@ -7,13 +7,18 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"math/rand"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/orgrim/carcass/environment"
+	"github.com/orgrim/carcass/hv"
 )
 
 // data storage tree fonctions
@@ -75,6 +80,22 @@ func environmentDir(path string, env string) (string, error) {
 	return filepath.Join(baseDir, "environments", env), nil
 }
 
+// isExtraNetwork tells if a network is an extra network of an environment,
+// their name is <env>_<name> and the underscore is not allowed in environment
+// names
+func isExtraNetwork(name string) bool {
+	return strings.Contains(name, "_")
+}
+
+func terraformConfigPath(path string, env string) (string, error) {
+	envPath, err := environmentDir(path, env)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(envPath, "terraform", "main.tf"), nil
+}
+
 func binaryDir(path string) (string, error) {
 	baseDir, err := expandDataDir(path)
 	if err != nil {
@@ -144,12 +165,101 @@ func tempFile(pattern string) string {
 	return filepath.Clean(filepath.Join(os.TempDir(), string(str)))
 }
 
+// lookupEnvironment finds the environment on the hypervisor and loads its
+// terraform configuration, when it can be found in the data directory
+func lookupEnvironment(h *hv.Hypervisor, name string) (*environment.Environment, error) {
+	env, err := environment.Lookup(h, name)
+	if err != nil {
+		return nil, err
+	}
+
+	tfConfigPath, err := terraformConfigPath(DataDir, name)
+	if err != nil {
+		log.Println("warning: invalid data directory:", err)
+		return env, nil
+	}
+
+	if _, err := os.Stat(tfConfigPath); err != nil {
+		log.Printf("warning: configuration of %s not found: %s", name, err)
+		return env, nil
+	}
+
+	if err := env.Infra.LoadConfig(tfConfigPath); err != nil {
+		log.Println("warning:", err)
+	}
+
+	return env, nil
+}
+
+// storeUserData copies a cloud-init user data file into the cloud-init
+// directory of the environment, prefixing its name. It returns the absolute
+// path of the copy, to be used in the terraform configuration.
+func storeUserData(envName string, prefix string, src string) (string, error) {
+	contents, err := os.ReadFile(src)
+	if err != nil {
+		return "", fmt.Errorf("could not read user data: %w", err)
+	}
+
+	return writeUserData(envName, fmt.Sprintf("%s-%s", prefix, filepath.Base(src)), contents)
+}
+
+// writeUserData writes a cloud-init fragment with the given name in the
+// cloud-init directory of the environment, it returns the absolute path of
+// the file
+func writeUserData(envName string, name string, contents []byte) (string, error) {
+	envPath, err := environmentDir(DataDir, envName)
+	if err != nil {
+		return "", fmt.Errorf("invalid data directory: %w", err)
+	}
+
+	dir, err := filepath.Abs(filepath.Join(envPath, "cloud-init"))
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("could not create cloud-init directory: %w", err)
+	}
+
+	dst := filepath.Join(dir, name)
+	if err := os.WriteFile(dst, contents, 0644); err != nil {
+		return "", fmt.Errorf("could not store user data: %w", err)
+	}
+
+	return dst, nil
+}
+
+// parseSize converts a size with an optional unit suffix (M, G or T) to
+// bytes, without suffix the size is in Gigabytes
+func parseSize(s string) (int64, error) {
+	unit := int64(1024 * 1024 * 1024)
+	num := strings.ToUpper(s)
+
+	switch {
+	case strings.HasSuffix(num, "M"):
+		unit = 1024 * 1024
+	case strings.HasSuffix(num, "G"):
+	case strings.HasSuffix(num, "T"):
+		unit = 1024 * 1024 * 1024 * 1024
+	default:
+		num += "G"
+	}
+
+	size, err := strconv.ParseInt(num[:len(num)-1], 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+
+	return size * unit, nil
+}
+
 // config related fonctions
 
 type localConfig struct {
 	StoragePool string `json:"storage_pool,omitempty"`
 	Username    string `json:"ssh_user,omitempty"`
 	SshPubKey   string `json:"ssh_pubkey,omitempty"`
+	SshKey      string `json:"ssh_key,omitempty"` // private key file
 }
 
 func loadConfig() (localConfig, error) {
@@ -62,3 +62,38 @@ func TestHasForbiddenChars(t *testing.T) {
 		})
 	}
 }
+
+func TestParseSize(t *testing.T) {
+	var tests = []struct {
+		input string
+		want  int64
+	}{
+		{"20", 20 << 30},
+		{"20G", 20 << 30},
+		{"512M", 512 << 20},
+		{"1t", 1 << 40},
+		{"", 0},
+		{"-2G", 0},
+		{"abc", 0},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got, err := parseSize(st.input)
+			if st.want == 0 {
+				if err == nil {
+					t.Errorf("got: %v, want an error", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if got != st.want {
+				t.Errorf("got: %v, want %v", got, st.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,417 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/orgrim/carcass/hv"
+	"github.com/orgrim/carcass/infra"
+	"github.com/orgrim/carcass/terraform"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cloneVmCmd.Flags().StringVar(&cloneIP, "ip", "", "IP Address of the clone, the next free one by default, in the reserved range in bridge mode")
+	cloneVmCmd.Flags().StringVar(&cloneIP6, "ip6", "", "IPv6 Address of the clone on dual-stack environments, the next free one by default")
+	cloneVmCmd.Flags().BoolVarP(&forceCapacity, "force", "f", false, "Clone the VM even if the host lacks resources")
+	vmCmd.AddCommand(cloneVmCmd)
+}
+
+var (
+	cloneVmCmd = &cobra.Command{
+		Use:   "clone <env> <src> <dst> [options]",
+		Short: "Add a copy of a VM to an environment",
+		Long: `Add a VM to an environment with a copy of the volumes of another VM. The
+source VM is paused while its volumes are copied, its filesystems are frozen
+first when the guest agent answers. The clone gets a new hostname, SSH host
+keys, machine-id and cloud-init instance-id. Interfaces on extra networks
+get the next free address of their network. The UEFI variables of the source
+are copied when the hypervisor is local`,
+		Run: clonevm,
+	}
+
+	cloneIP  string
+	cloneIP6 string
+)
+
+// cloneUserData regenerates the systemd machine-id of a clone, cloud-init
+// takes care of the hostname and SSH host keys because the instance-id
+// changes
+const cloneUserData = `#cloud-config
+runcmd:
+  - [ sh, -c, "rm -f /etc/machine-id /var/lib/dbus/machine-id && systemd-machine-id-setup" ]
+`
+
+func clonevm(cmd *cobra.Command, args []string) {
+	if len(args) < 3 {
+		log.Fatalln("missing environment name, source or destination vm name")
+	}
+
+	envName, srcName := envVmArgs(args)
+	dstName := args[2]
+	if hasForbiddenChars(dstName) || len(dstName) == 0 {
+		log.Fatalln("invalid vm name")
+	}
+
+	tfConfigDir, conf := loadEnvConfig(envName)
+	mod := conf.Module
+
+	src, ok := mod.Machines[srcName]
+	if !ok {
+		log.Fatalln("source VM not found in the terraform config of the environment")
+	}
+
+	if _, ok := mod.Machines[dstName]; ok {
+		log.Fatalln("destination VM already exists in the environment")
+	}
+
+	if cloneIP == "" {
+		ip, err := mod.NextFreeIP("")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		cloneIP = ip
+		log.Printf("using IP address %s for %s", cloneIP, dstName)
+	} else if err := mod.CheckIP("", dstName, cloneIP); err != nil {
+		log.Fatalln(err)
+	}
+
+	if mod.NetworkCIDR6 == "" {
+		if cloneIP6 != "" {
+			log.Fatalln("environment has no IPv6 network")
+		}
+	} else if cloneIP6 == "" {
+		ip, err := mod.NextFreeIP6()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		cloneIP6 = ip
+		log.Printf("using IPv6 address %s for %s", cloneIP6, dstName)
+	} else if err := mod.CheckIP6(dstName, cloneIP6); err != nil {
+		log.Fatalln(err)
+	}
+
+	nics := make([]terraform.Nic, 0, len(src.Nics))
+	for _, n := range src.Nics {
+		nic, err := parseNicSpec(mod, dstName, n.Network)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		nics = append(nics, nic)
+	}
+
+	h, err := hv.NewHypervisor(Uri)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	checkCapacity(&h, infra.Resources{
+		Vcpus:  src.Vcpus,
+		Memory: int64(src.Memory) * 1024 * 1024,
+		Disks:  diskNeeds(mod, src.Disks),
+	})
+	h.Close()
+
+	fragment, err := writeUserData(envName, fmt.Sprintf("%s-clone.yaml", dstName), []byte(cloneUserData))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	pool := mod.StoragePool
+	if pool == "" {
+		pool = "default"
+	}
+
+	// copy the volumes, the terraform resources they are imported into
+	// are given along with their id
+	imports, volumes, err := cloneVolumes(mod, pool, srcName, dstName)
+	if err != nil {
+		removeVolumes(volumes)
+		os.Remove(fragment)
+		log.Fatalln(err)
+	}
+
+	// libvirt keeps an existing NVRAM file instead of creating it from
+	// the template, the clone gets the UEFI variables of the source
+	nvram := ""
+	if src.Firmware == "uefi" || src.Firmware == "uefi-secure" {
+		nvram, err = cloneNvram(mod, srcName, dstName)
+		if err != nil {
+			log.Printf("warning: %s, the clone starts with fresh UEFI variables", err)
+		}
+	}
+
+	userData := make([]string, 0, len(src.UserData)+1)
+	userData = append(userData, src.UserData...)
+	userData = append(userData, fragment)
+
+	disks := make([]terraform.DataDisk, len(src.Disks))
+	copy(disks, src.Disks)
+
+	groups := make([]string, len(src.Groups))
+	copy(groups, src.Groups)
+
+	conf.Module.Machines[dstName] = terraform.Machine{
+		IPAddress:  cloneIP,
+		IPAddress6: cloneIP6,
+		Distrib:    src.Distrib,
+		Vcpus:      src.Vcpus,
+		Memory:     src.Memory,
+		Disks:      disks,
+		Iface:      src.Iface,
+		Nics:       nics,
+		UserData:   userData,
+		Groups:     groups,
+		BootGroup:  src.BootGroup,
+		DiskBus:    src.DiskBus,
+		DiskCache:  src.DiskCache,
+		DiskIO:     src.DiskIO,
+		NicModel:   src.NicModel,
+		CpuMode:    src.CpuMode,
+		CpuModel:   src.CpuModel,
+		Sockets:    src.Sockets,
+		Cores:      src.Cores,
+		Threads:    src.Threads,
+		Nested:     src.Nested,
+		Firmware:   src.Firmware,
+		Shares:     append([]terraform.Share{}, src.Shares...),
+		Instance:   fmt.Sprintf("%s.%s-%d", dstName, mod.Domain, time.Now().Unix()),
+		GuestAgent: src.GuestAgent,
+		AgentPkg:   src.AgentPkg,
+	}
+
+	// keep the current configuration, it is restored when the clone
+	// cannot be completed
+	tfConfigPath := filepath.Join(tfConfigDir, "main.tf")
+	prevConfig, err := os.ReadFile(tfConfigPath)
+	if err != nil {
+		removeVolumes(volumes)
+		os.Remove(fragment)
+		if nvram != "" {
+			os.Remove(nvram)
+		}
+		log.Fatalln(err)
+	}
+
+	binDir, _ := binaryDir(DataDir)
+	imported := make([]string, 0, len(imports))
+	applied := false
+
+	rollback := func() {
+		log.Printf("removing %s from the environment", dstName)
+		for _, addr := range imported {
+			if err := terraform.StateRemove(binDir, tfConfigDir, addr); err != nil {
+				log.Printf("could not remove %s from the terraform state: %s", addr, err)
+			}
+		}
+
+		if err := os.WriteFile(tfConfigPath, prevConfig, 0644); err != nil {
+			log.Printf("could not restore %s: %s", tfConfigPath, err)
+			return
+		}
+
+		// destroy what terraform has created for the clone before
+		// failing
+		if applied {
+			if err := terraform.Apply(binDir, tfConfigDir); err != nil {
+				log.Println("could not apply the previous configuration:", err)
+			} else if err := syncDNSTXT(mod); err != nil {
+				log.Println("warning:", err)
+			}
+		}
+
+		removeVolumes(volumes)
+		os.Remove(fragment)
+		if nvram != "" {
+			os.Remove(nvram)
+		}
+	}
+
+	// terraform needs the resources in the configuration to import the
+	// volumes
+	if err := writeEnvConfig(tfConfigDir, conf); err != nil {
+		rollback()
+		log.Fatalln(err)
+	}
+
+	if err := initEnvConfig(binDir, tfConfigDir, conf); err != nil {
+		rollback()
+		log.Fatalln(err)
+	}
+
+	for _, imp := range imports {
+		addr := fmt.Sprintf("module.%s.%s", mod.Name, imp[0])
+		if err := terraform.Import(binDir, tfConfigDir, addr, imp[1]); err != nil {
+			rollback()
+			log.Fatalf("could not import %s: %s", addr, err)
+		}
+		imported = append(imported, addr)
+	}
+
+	applied = true
+	if err := applyEnvConfig(tfConfigDir, conf); err != nil {
+		rollback()
+		log.Fatalln(err)
+	}
+
+	// Force dnsmasq to re-read the addn-hosts file so that we can resolv
+	// the name of the vm, libvirt does not serve the DNS of bridged
+	// networks
+	if conf.Module.NetworkMode != "bridge" {
+		if err := restartDnsmasq(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// cloneVolumes copies the system and data volumes of the source VM to the
+// volumes of the destination VM. The source VM is paused during the copy
+// when it is running. It returns the terraform resource address and id of
+// each new volume, and the pool and name of the volumes copied so far, even
+// on error, so that they can be removed.
+func cloneVolumes(mod terraform.Module, pool string, srcName string, dstName string) ([][2]string, [][2]string, error) {
+	h, err := hv.NewHypervisor(Uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer h.Close()
+
+	srcDom := fmt.Sprintf("%s.%s", srcName, mod.Domain)
+	state, err := hv.DomainState(h, srcDom)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if state == "running" {
+		// flush the filesystems of the guest when its agent answers, the
+		// copy of the volumes is consistent then
+		if err := hv.FreezeFilesystems(h, srcDom); err != nil {
+			log.Println("warning:", err)
+		} else {
+			defer func() {
+				if err := hv.ThawFilesystems(h, srcDom); err != nil {
+					log.Println(err)
+				}
+			}()
+		}
+
+		log.Printf("request pause of: %s", srcDom)
+		if err := hv.ControlDomain(h, srcDom, "pause"); err != nil {
+			return nil, nil, err
+		}
+
+		defer func() {
+			log.Printf("request resume of: %s", srcDom)
+			if err := hv.ControlDomain(h, srcDom, "resume"); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+
+	imports := make([][2]string, 0)
+	volumes := make([][2]string, 0)
+
+	log.Printf("copying system volume of %s", srcName)
+	volName := terraform.OSVolumeName(dstName, mod.Domain)
+	vol, err := hv.CloneVolume(h, pool, terraform.OSVolumeName(srcName, mod.Domain), volName)
+	if err != nil {
+		return nil, volumes, err
+	}
+	volumes = append(volumes, [2]string{pool, volName})
+	imports = append(imports, [2]string{fmt.Sprintf("libvirt_volume.os_volume[%q]", dstName), vol.Key})
+
+	src := mod.Machines[srcName]
+	for n, disk := range src.Disks {
+		diskPool := disk.Pool
+		if diskPool == "" {
+			diskPool = pool
+		}
+
+		log.Printf("copying data volume %d of %s", n, srcName)
+		volName := terraform.DataVolumeName(dstName, mod.Domain, n)
+		vol, err := hv.CloneVolume(h, diskPool, terraform.DataVolumeName(srcName, mod.Domain, n), volName)
+		if err != nil {
+			return nil, volumes, err
+		}
+		volumes = append(volumes, [2]string{diskPool, volName})
+
+		imports = append(imports, [2]string{fmt.Sprintf("libvirt_volume.data_volume[%q]", terraform.DataVolumeKey(dstName, n)), vol.Key})
+	}
+
+	return imports, volumes, nil
+}
+
+// cloneNvram copies the NVRAM file of the source VM to the one of the
+// destination VM. The NVRAM directory is not a storage pool, the file can only
+// be copied when the hypervisor is local. It returns the path of the copy,
+// empty when there is nothing to copy.
+func cloneNvram(mod terraform.Module, srcName string, dstName string) (string, error) {
+	h, err := hv.NewHypervisor(Uri)
+	if err != nil {
+		return "", err
+	}
+	defer h.Close()
+
+	if !h.IsLocal() {
+		return "", fmt.Errorf("cannot copy the NVRAM file of %s on a remote hypervisor", srcName)
+	}
+
+	dir := mod.NvramDir
+	if dir == "" {
+		dir, err = h.NvramDir()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// the names follow the nvram file of the domains in the module
+	srcPath := filepath.Join(dir, fmt.Sprintf("%s.%s_VARS.fd", srcName, mod.Domain))
+	dstPath := filepath.Join(dir, fmt.Sprintf("%s.%s_VARS.fd", dstName, mod.Domain))
+
+	// the file is created on the first start of the source
+	contents, err := os.ReadFile(srcPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not read the NVRAM file of %s: %w", srcName, err)
+	}
+
+	log.Printf("copying NVRAM file of %s", srcName)
+	if err := os.WriteFile(dstPath, contents, 0600); err != nil {
+		os.Remove(dstPath)
+		return "", fmt.Errorf("could not copy the NVRAM file of %s: %w", srcName, err)
+	}
+
+	return dstPath, nil
+}
+
+// removeVolumes deletes the volumes given by pool and name, errors are only
+// reported
+func removeVolumes(volumes [][2]string) {
+	if len(volumes) == 0 {
+		return
+	}
+
+	h, err := hv.NewHypervisor(Uri)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer h.Close()
+
+	for _, v := range volumes {
+		log.Printf("removing volume %s::%s", v[0], v[1])
+		if err := hv.RemoveVolume(h, v[0], v[1]); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/orgrim/carcass/hv"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	vmCmd.AddCommand(startVmCmd)
+
+	stopVmCmd.Flags().DurationVarP(&stopVmTimeout, "timeout", "t", time.Minute, "time to wait for the shutdown before destroying the VM, 0 to not wait")
+	stopVmCmd.Flags().BoolVar(&stopVmHard, "hard", false, "destroy the VM right away, like pulling the plug")
+	vmCmd.AddCommand(stopVmCmd)
+
+	vmCmd.AddCommand(rebootVmCmd)
+	vmCmd.AddCommand(resetVmCmd)
+	vmCmd.AddCommand(pauseVmCmd)
+	vmCmd.AddCommand(resumeVmCmd)
+}
+
+var (
+	startVmCmd = &cobra.Command{
+		Use:   "start <env> <shortname>",
+		Short: "Start a VM",
+		Run:   controlVm,
+	}
+
+	stopVmCmd = &cobra.Command{
+		Use:   "stop <env> <shortname>",
+		Short: "Stop a VM",
+		Long: `Request a graceful shutdown of a VM and wait for it to stop. The VM is
+destroyed when it is still running after the timeout`,
+		Run: controlVm,
+	}
+
+	rebootVmCmd = &cobra.Command{
+		Use:   "reboot <env> <shortname>",
+		Short: "Reboot a VM gracefully",
+		Run:   controlVm,
+	}
+
+	resetVmCmd = &cobra.Command{
+		Use:   "reset <env> <shortname>",
+		Short: "Reset a VM, like the reset button",
+		Run:   controlVm,
+	}
+
+	pauseVmCmd = &cobra.Command{
+		Use:   "pause <env> <shortname>",
+		Short: "Suspend the execution of a VM",
+		Run:   controlVm,
+	}
+
+	resumeVmCmd = &cobra.Command{
+		Use:   "resume <env> <shortname>",
+		Short: "Resume the execution of a paused VM",
+		Run:   controlVm,
+	}
+
+	stopVmTimeout time.Duration
+	stopVmHard    bool
+)
+
+func controlVm(cmd *cobra.Command, args []string) {
+	envName, vmName := envVmArgs(args)
+
+	h, err := hv.NewHypervisor(Uri)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer h.Close()
+
+	env, err := lookupEnvironment(&h, envName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	domName := fmt.Sprintf("%s.%s", vmName, env.Domain)
+
+	// some actions, like stop without waiting, ignore missing domains
+	found := false
+	for _, m := range env.Infra.Machines {
+		if m.Name == domName {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		h.Close()
+		log.Fatalf("VM %s not found in environment %s", vmName, envName)
+	}
+
+	switch cmd.Name() {
+	case "start":
+		err = env.Infra.Start(domName)
+	case "stop":
+		switch {
+		case stopVmHard:
+			err = env.Infra.Destroy(domName)
+		case stopVmTimeout == 0:
+			err = env.Infra.Stop(domName, false)
+		default:
+			err = env.Infra.ShutdownWait(domName, stopVmTimeout, true)
+		}
+	case "reboot":
+		err = env.Infra.Reboot(domName)
+	case "reset":
+		err = env.Infra.Reset(domName)
+	case "pause":
+		err = env.Infra.Pause(domName)
+	case "resume":
+		err = env.Infra.Resume(domName)
+	}
+
+	if err != nil {
+		h.Close()
+		log.Fatalln(err)
+	}
+}
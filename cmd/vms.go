@@ -6,19 +6,46 @@ package cmd
 
 import (
 	"errors"
+	"fmt"
+	"github.com/orgrim/carcass/hv"
+	"github.com/orgrim/carcass/infra"
 	"github.com/orgrim/carcass/terraform"
 	"github.com/spf13/cobra"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 func init() {
-	addVmCmd.Flags().StringVar(&ipAddress, "ip", "", "IP Address of the VM in the network of the environment")
+	addVmCmd.Flags().StringVar(&ipAddress, "ip", "", "IP Address of the VM in the network of the environment, the next free one by default, in the reserved range in bridge mode")
+	addVmCmd.Flags().StringVar(&ipAddress6, "ip6", "", "IPv6 Address of the VM on dual-stack environments, the next free one by default")
 	addVmCmd.Flags().StringVar(&distrib, "distrib", "debian10", "Codename of the OS of the VM. See image")
 	addVmCmd.Flags().IntVar(&vcpu, "vcpu", 2, "Number of vCPUs")
 	addVmCmd.Flags().IntVar(&memory, "ram", 2048, "Amount of RAM in Megabytes")
-	addVmCmd.Flags().IntVar(&dataSize, "data", 8, "Size of the data disk in Gigabytes")
+	addVmCmd.Flags().IntVar(&dataSize, "data", 8, "Size of the data disk in Gigabytes, when no --disk is given")
+	addVmCmd.Flags().StringArrayVar(&diskSpecs, "disk", nil, "Add a data disk, as SIZE[:POOL], e.g. 20G or 100G:ssd-pool. Can be repeated")
+	addVmCmd.Flags().StringArrayVar(&nicSpecs, "nic", nil, "Add an interface on an extra network, as NETWORK[:IP]. Can be repeated")
+	addVmCmd.Flags().StringArrayVar(&vmUserData, "cloud-init", nil, "Cloud-init user data file merged into the base template. Can be repeated")
+	addVmCmd.Flags().StringArrayVar(&vmGroups, "group", nil, "Add the VM to a group, e.g. db. Can be repeated")
+	addVmCmd.Flags().IntVar(&bootGroup, "boot-group", 0, "Boot group of the VM, lower groups are started first")
+	addVmCmd.Flags().StringVar(&diskBus, "disk-bus", "", "Bus of the disks: virtio, scsi or sata. Default from the environment")
+	addVmCmd.Flags().StringVar(&diskCache, "disk-cache", "", "Cache mode of the disks, e.g. none or writeback. Default from the environment")
+	addVmCmd.Flags().StringVar(&diskIO, "disk-io", "", "IO mode of the disks: native, threads or io_uring. Default from the environment")
+	addVmCmd.Flags().StringVar(&nicModel, "nic-model", "", "Model of the network interfaces, e.g. virtio or e1000. Default from the environment")
+	addVmCmd.Flags().StringVar(&cpuMode, "cpu-mode", "", "CPU mode: host-passthrough, host-model or custom. Default from libvirt")
+	addVmCmd.Flags().StringVar(&cpuModel, "cpu-model", "", "CPU model with the custom CPU mode, e.g. Skylake-Server")
+	addVmCmd.Flags().IntVar(&cpuSockets, "sockets", 0, "Number of CPU sockets, sockets x cores x threads must match --vcpu")
+	addVmCmd.Flags().IntVar(&cpuCores, "cores", 0, "Number of cores per CPU socket")
+	addVmCmd.Flags().IntVar(&cpuThreads, "threads", 0, "Number of threads per CPU core")
+	addVmCmd.Flags().BoolVar(&nested, "nested", false, "Allow the VM to run VMs, uses the host-passthrough CPU mode by default")
+	addVmCmd.Flags().StringVar(&firmware, "firmware", "", "Firmware of the VM: bios, uefi or uefi-secure. Default from the image")
+	addVmCmd.Flags().StringArrayVar(&shareSpecs, "share", nil, "Mount a directory of the host in the VM, as /host/path:/mnt/point. Can be repeated")
+	addVmCmd.Flags().StringVar(&shareDriver, "share-driver", "auto", "Driver of the shared directories: virtiofs, 9p or auto to use virtiofs when available")
+	addVmCmd.Flags().BoolVar(&guestAgent, "guest-agent", true, "Add a channel for the qemu guest agent to the VM")
+	addVmCmd.Flags().BoolVar(&agentPackage, "agent-package", true, "Install the qemu guest agent with cloud-init, off by default on isolated environments")
+	addVmCmd.Flags().IntVar(&addCount, "count", 1, "Number of VMs to add, named after shortname followed by 1 to count")
+	addVmCmd.Flags().BoolVarP(&forceCapacity, "force", "f", false, "Add the VM even if the host lacks resources")
 	vmCmd.AddCommand(addVmCmd)
 
 	vmCmd.AddCommand(rmVmCmd)
@@ -35,14 +62,54 @@ var (
 	addVmCmd = &cobra.Command{
 		Use:   "add <env> <shortname> [options]",
 		Short: "Add a VM to an environment",
-		Run:   addvm,
+		Long: `Add a VM to an environment. The cloud-init user data given to the VM is kept
+in terraform/cloud-init of the directory of the environment. When the
+environment or the VM have fragments, it is <vm>.mime, a MIME multi-part
+document with the base template followed by the fragments of the
+environment and the VM, cloud-init merges them in this order. Otherwise, it
+is the base template alone in <vm>.yaml.
+
+With --count, the VMs are named after the shortname followed by a number,
+e.g. pg1, pg2 and pg3, their IP addresses follow each other, on extra
+networks too`,
+		Run: addvm,
 	}
 
-	ipAddress string
-	distrib   string
-	vcpu      int
-	memory    int
-	dataSize  int
+	ipAddress  string
+	ipAddress6 string
+	distrib    string
+	vcpu       int
+	memory     int
+	dataSize   int
+	diskSpecs  []string
+	nicSpecs   []string
+	bootGroup  int
+
+	vmUserData []string
+	vmGroups   []string
+
+	diskBus   string
+	diskCache string
+	diskIO    string
+	nicModel  string
+
+	cpuMode    string
+	cpuModel   string
+	cpuSockets int
+	cpuCores   int
+	cpuThreads int
+	nested     bool
+	firmware   string
+
+	shareSpecs  []string
+	shareDriver string
+
+	guestAgent   bool
+	agentPackage bool
+
+	addCount int
+
+	forceCapacity bool
 
 	rmVmCmd = &cobra.Command{
 		Use:   "rm <env> <shortname>",
@@ -52,73 +119,416 @@ var (
 )
 
 func addvm(cmd *cobra.Command, args []string) {
-	if len(args) < 2 {
-		log.Fatalln("missing environment name ov vm name")
+	envName, vmName := envVmArgs(args)
+
+	tfConfigDir, conf := loadEnvConfig(envName)
+
+	names := []string{vmName}
+	if addCount > 1 {
+		names = make([]string, 0, addCount)
+		for i := 1; i <= addCount; i++ {
+			names = append(names, fmt.Sprintf("%s%d", vmName, i))
+		}
+	} else if addCount < 1 {
+		log.Fatalln("invalid count:", addCount)
 	}
 
-	envName := args[0]
-	if hasForbiddenChars(envName) || len(envName) == 0 {
-		log.Fatalln("invalid environment name")
+	// adding an existing VM would replace it, terraform would then
+	// recreate it with its disks
+	for _, name := range names {
+		if _, ok := conf.Module.Machines[name]; ok {
+			log.Fatalf("VM %s already exists in the environment", name)
+		}
 	}
 
-	vmName := args[1]
-	if hasForbiddenChars(vmName) || len(vmName) == 0 {
-		log.Fatalln("invalid vm name")
+	disks := make([]terraform.DataDisk, 0, len(diskSpecs))
+	for _, spec := range diskSpecs {
+		disk, err := parseDiskSpec(spec)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		disks = append(disks, disk)
 	}
 
-	envPath, err := environmentDir(DataDir, envName)
-	if err != nil {
-		log.Fatalln("invalid data directory:", err)
+	if len(diskSpecs) == 0 && dataSize > 0 {
+		disks = append(disks, terraform.DataDisk{Size: int64(dataSize) * 1024 * 1024 * 1024})
 	}
 
-	_, err = os.Stat(envPath)
-	if errors.Is(err, os.ErrNotExist) {
-		log.Fatalln("environment does not exist")
+	// there is no package mirror to install the guest agent from on
+	// isolated environments
+	if conf.Module.NetworkMode == "isolated" && !cmd.Flags().Changed("agent-package") {
+		agentPackage = false
 	}
 
-	if ipAddress == "" {
-		log.Fatalln("missing IP address")
+	groups := make([]string, 0, len(vmGroups))
+	for _, g := range vmGroups {
+		if hasForbiddenChars(g) || len(g) == 0 {
+			log.Fatalln("invalid group name:", g)
+		}
+		groups = append(groups, g)
 	}
 
-	tfConfigDir := filepath.Join(envPath, "terraform")
-	tfConfigPath := filepath.Join(tfConfigDir, "main.tf")
+	// the IO mode depends on the cache mode, which may come from the
+	// defaults of the environment
+	if err := terraform.CheckDeviceOptions(orDefault(diskBus, conf.Module.DiskBus), orDefault(diskCache, conf.Module.DiskCache),
+		orDefault(diskIO, conf.Module.DiskIO), orDefault(nicModel, conf.Module.NicModel)); err != nil {
+		log.Fatalln(err)
+	}
 
-	conf, err := terraform.ParseModuleConfig(tfConfigPath)
-	if err != nil {
+	if err := terraform.CheckCPUOptions(cpuMode, cpuModel, cpuSockets, cpuCores, cpuThreads, vcpu); err != nil {
 		log.Fatalln(err)
 	}
 
-	conf.Module.Machines[vmName] = terraform.Machine{
-		IPAddress:    ipAddress,
-		Distrib:      distrib,
-		Vcpus:        vcpu,
-		Memory:       memory,
-		DataDiskSize: dataSize * 1024 * 1024 * 1024,
-		Iface:        selectIFace(distrib),
+	if firmware == "" {
+		if dataDir, err := expandDataDir(DataDir); err == nil {
+			firmware = infra.LookupImageFirmware(dataDir, orDefault(conf.Module.StoragePool, "default"), distrib)
+		}
 	}
 
-	dst, err := os.Create(tfConfigPath)
+	if err := terraform.CheckFirmware(firmware); err != nil {
+		log.Fatalln(err)
+	}
+
+	// the connection is only needed to check the host, terraform makes
+	// its own
+	h, err := hv.NewHypervisor(Uri)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	if err := terraform.WriteModuleConfig(dst, conf); err != nil {
-		dst.Close()
+	if err := setupFirmware(&h, &conf.Module, firmware); err != nil {
+		h.Close()
 		log.Fatalln(err)
 	}
 
-	dst.Close()
+	// the parameters of the kvm module can only be read on the local host
+	if nested && h.IsLocal() && !hv.NestedVirtEnabled() {
+		log.Println("warning: nested virtualization is not enabled in the kvm module of the host")
+	}
 
-	binDir, _ := binaryDir(DataDir)
-	if err := terraform.Apply(binDir, tfConfigDir); err != nil {
+	shares, err := parseShareSpecs(&h, shareSpecs, shareDriver)
+	if err != nil {
+		h.Close()
 		log.Fatalln(err)
 	}
 
-	// Force dnsmasq to re-read the addn-hosts file so that we can resolv
-	// the name of the vm
-	if err := restartDnsmasq(); err != nil {
+	diskNeed := diskNeeds(conf.Module, disks)
+	for pool := range diskNeed {
+		diskNeed[pool] *= int64(len(names))
+	}
+
+	// vCPUs are overcommitted, only the ones of a single VM are checked
+	// against the CPUs of the host
+	checkCapacity(&h, infra.Resources{
+		Vcpus:  vcpu,
+		Memory: int64(memory) * 1024 * 1024 * int64(len(names)),
+		Disks:  diskNeed,
+	})
+	h.Close()
+
+	for i, name := range names {
+		// with a count, the given IP address is the one of the first VM
+		// and the others follow
+		ip := ipAddress
+		if ip == "" {
+			ip, err = conf.Module.NextFreeIP("")
+			if err != nil {
+				log.Fatalln(err)
+			}
+			log.Printf("using IP address %s for %s", ip, name)
+		} else {
+			ip = terraform.AddIP(ip, i)
+			if err := conf.Module.CheckIP("", name, ip); err != nil {
+				log.Fatalln(err)
+			}
+		}
+
+		ip6 := ipAddress6
+		if conf.Module.NetworkCIDR6 == "" {
+			if ip6 != "" {
+				log.Fatalln("environment has no IPv6 network")
+			}
+		} else if ip6 == "" {
+			ip6, err = conf.Module.NextFreeIP6()
+			if err != nil {
+				log.Fatalln(err)
+			}
+			log.Printf("using IPv6 address %s for %s", ip6, name)
+		} else {
+			ip6 = terraform.AddIP(ip6, i)
+			if err := conf.Module.CheckIP6(name, ip6); err != nil {
+				log.Fatalln(err)
+			}
+		}
+
+		// the machine is registered before allocating the addresses of
+		// the next one
+		nics := make([]terraform.Nic, 0, len(nicSpecs))
+		for _, spec := range nicSpecs {
+			// like --ip, a given address is the one of the first VM
+			if parts := strings.SplitN(spec, ":", 2); len(parts) == 2 && i > 0 {
+				spec = fmt.Sprintf("%s:%s", parts[0], terraform.AddIP(parts[1], i))
+			}
+
+			nic, err := parseNicSpec(conf.Module, name, spec)
+			if err != nil {
+				log.Fatalln(err)
+			}
+
+			for _, n := range nics {
+				if n.Network == nic.Network {
+					log.Fatalf("network %s given more than once", nic.Network)
+				}
+			}
+
+			nics = append(nics, nic)
+		}
+
+		userData := make([]string, 0, len(vmUserData))
+		for _, src := range vmUserData {
+			path, err := storeUserData(envName, name, src)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			userData = append(userData, path)
+		}
+
+		conf.Module.Machines[name] = terraform.Machine{
+			IPAddress:  ip,
+			IPAddress6: ip6,
+			Distrib:    distrib,
+			Vcpus:      vcpu,
+			Memory:     memory,
+			Disks:      append([]terraform.DataDisk{}, disks...),
+			Iface:      selectIFace(distrib),
+			Nics:       nics,
+			UserData:   userData,
+			Groups:     append([]string{}, groups...),
+			BootGroup:  bootGroup,
+			DiskBus:    diskBus,
+			DiskCache:  diskCache,
+			DiskIO:     diskIO,
+			NicModel:   nicModel,
+			CpuMode:    cpuMode,
+			CpuModel:   cpuModel,
+			Sockets:    cpuSockets,
+			Cores:      cpuCores,
+			Threads:    cpuThreads,
+			Nested:     nested,
+			Firmware:   firmware,
+			Shares:     append([]terraform.Share{}, shares...),
+			GuestAgent: guestAgent,
+			AgentPkg:   guestAgent && agentPackage,
+		}
+	}
+
+	if err := applyEnvConfig(tfConfigDir, conf); err != nil {
 		log.Fatalln(err)
 	}
+
+	// Force dnsmasq to re-read the addn-hosts file so that we can resolv
+	// the name of the vm, libvirt does not serve the DNS of bridged
+	// networks
+	if conf.Module.NetworkMode != "bridge" {
+		if err := restartDnsmasq(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// parseDiskSpec reads the definition of a data disk from the command line, in
+// the form SIZE[:POOL]
+func parseDiskSpec(spec string) (terraform.DataDisk, error) {
+	parts := strings.SplitN(spec, ":", 2)
+
+	size, err := parseSize(parts[0])
+	if err != nil {
+		return terraform.DataDisk{}, fmt.Errorf("invalid disk %s: %w", spec, err)
+	}
+
+	disk := terraform.DataDisk{Size: size}
+	if len(parts) == 2 {
+		if hasForbiddenChars(parts[1]) || len(parts[1]) == 0 {
+			return terraform.DataDisk{}, fmt.Errorf("invalid storage pool in disk %s", spec)
+		}
+		disk.Pool = parts[1]
+	}
+
+	return disk, nil
+}
+
+// parseNicSpec reads the definition of an extra interface from the command
+// line, in the form NETWORK[:IP]. The IP address is checked or allocated in
+// the network.
+func parseNicSpec(mod terraform.Module, vmName string, spec string) (terraform.Nic, error) {
+	parts := strings.SplitN(spec, ":", 2)
+
+	nic := terraform.Nic{Network: parts[0]}
+	if len(parts) == 2 {
+		if err := mod.CheckIP(nic.Network, vmName, parts[1]); err != nil {
+			return terraform.Nic{}, err
+		}
+		nic.IPAddress = parts[1]
+	} else {
+		ip, err := mod.NextFreeIP(nic.Network)
+		if err != nil {
+			return terraform.Nic{}, err
+		}
+		nic.IPAddress = ip
+		log.Printf("using IP address %s on network %s for %s", ip, nic.Network, vmName)
+	}
+
+	nic.Mac = terraform.MacFromIP(nic.IPAddress)
+
+	return nic, nil
+}
+
+// parseShareSpecs reads the definitions of shared directories from the
+// command line, in the form /host/path:/mnt/point. With the auto driver,
+// virtiofs is used when the hypervisor supports it, 9p otherwise. The source
+// directory is only checked on a local hypervisor.
+func parseShareSpecs(h *hv.Hypervisor, specs []string, driver string) ([]terraform.Share, error) {
+	shares := make([]terraform.Share, 0, len(specs))
+	if len(specs) == 0 {
+		return shares, nil
+	}
+
+	switch driver {
+	case "virtiofs", "9p":
+	case "auto":
+		driver = "9p"
+		if hv.VirtiofsSupported(*h) {
+			driver = "virtiofs"
+		}
+		log.Printf("using %s for shared directories", driver)
+	default:
+		return nil, fmt.Errorf("invalid share driver: %s", driver)
+	}
+
+	for _, spec := range specs {
+		// the mount point goes in a shell command and in fstab
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) != 2 || !filepath.IsAbs(parts[1]) || strings.ContainsAny(parts[1], " \t'\"") {
+			return nil, fmt.Errorf("invalid share %s, expected /host/path:/mnt/point", spec)
+		}
+
+		// the source goes as is in the XML of the domain
+		if strings.ContainsAny(parts[0], "&<>'\"") {
+			return nil, fmt.Errorf("invalid share %s: the source path must not contain any of &<>'\"", spec)
+		}
+
+		// the source can only be checked when it is on the local host,
+		// a relative path means nothing on a remote one
+		src := filepath.Clean(parts[0])
+		if h.IsLocal() {
+			var err error
+			src, err = filepath.Abs(src)
+			if err != nil {
+				return nil, fmt.Errorf("invalid share %s: %w", spec, err)
+			}
+
+			if fi, err := os.Stat(src); err != nil || !fi.IsDir() {
+				return nil, fmt.Errorf("invalid share %s: %s is not a directory", spec, src)
+			}
+		} else if !filepath.IsAbs(src) {
+			return nil, fmt.Errorf("invalid share %s: the source path must be absolute on a remote hypervisor", spec)
+		}
+
+		shares = append(shares, terraform.Share{Source: src, Target: filepath.Clean(parts[1]), Driver: driver})
+	}
+
+	return shares, nil
+}
+
+// diskNeeds sums the size of the disks by storage pool
+func diskNeeds(mod terraform.Module, disks []terraform.DataDisk) map[string]int64 {
+	defPool := mod.StoragePool
+	if defPool == "" {
+		defPool = "default"
+	}
+
+	needs := make(map[string]int64)
+	for _, disk := range disks {
+		if disk.Pool == "" {
+			needs[defPool] += disk.Size
+		} else {
+			needs[disk.Pool] += disk.Size
+		}
+	}
+
+	return needs
+}
+
+// checkCapacity verifies that the host has enough resources for the needs of
+// a VM and exits when it does not, unless forced
+func checkCapacity(h *hv.Hypervisor, need infra.Resources) {
+	report, err := infra.CheckCapacity(h, need)
+	if err != nil {
+		log.Println("warning:", err)
+		return
+	}
+
+	if report.Ok() {
+		return
+	}
+
+	fmt.Printf("Host capacity check failed:\n%s", report)
+	if !forceCapacity {
+		h.Close()
+		log.Fatalln("not enough resources on the host, use --force to override")
+	}
+
+	log.Println("warning: not enough resources on the host, forcing")
+}
+
+// setupFirmware finds the OVMF files on the host when the machine needs UEFI
+// and the module does not know them yet
+func setupFirmware(h *hv.Hypervisor, mod *terraform.Module, firmware string) error {
+	if firmware != "uefi" && firmware != "uefi-secure" {
+		return nil
+	}
+
+	if mod.NvramDir == "" {
+		dir, err := h.NvramDir()
+		if err != nil {
+			return err
+		}
+		mod.NvramDir = dir
+	}
+
+	switch firmware {
+	case "uefi":
+		if mod.OvmfCode != "" {
+			return nil
+		}
+
+		code, err := hv.FindOVMF(*h, false)
+		if err != nil {
+			return err
+		}
+		mod.OvmfCode = code
+	case "uefi-secure":
+		if mod.OvmfSbCode != "" {
+			return nil
+		}
+
+		code, err := hv.FindOVMF(*h, true)
+		if err != nil {
+			return err
+		}
+		mod.OvmfSbCode = code
+	}
+
+	return nil
+}
+
+// orDefault gives v or def when v is empty
+func orDefault(v string, def string) string {
+	if v == "" {
+		return def
+	}
+
+	return v
 }
 
 func selectIFace(distrib string) string {
@@ -139,6 +549,41 @@ func selectIFace(distrib string) string {
 }
 
 func rmvm(cmd *cobra.Command, args []string) {
+	envName, vmName := envVmArgs(args)
+
+	tfConfigDir, conf := loadEnvConfig(envName)
+
+	if _, ok := conf.Module.Machines[vmName]; !ok {
+		log.Fatalln("VM not found in the terraform config of the environment")
+	}
+
+	for _, r := range conf.Module.DNSRecords {
+		if r.Type == "alias" && r.Value == vmName || r.Type == "srv" && strings.HasPrefix(r.Value, vmName+":") {
+			log.Fatalf("VM is the target of the DNS record %s %s, remove it first", r.Type, r.Name)
+		}
+	}
+
+	delete(conf.Module.Machines, vmName)
+
+	if err := applyEnvConfig(tfConfigDir, conf); err != nil {
+		log.Fatalln(err)
+	}
+
+	// the ports forwarded to the VM lead nowhere now
+	stopVmForwards(envName, vmName)
+
+	// Force dnsmasq to re-read the addn-hosts file so that we can resolv
+	// the name of the vm, libvirt does not serve the DNS of bridged
+	// networks
+	if conf.Module.NetworkMode != "bridge" {
+		if err := restartDnsmasq(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// envVmArgs validates the environment and VM names given on the command line
+func envVmArgs(args []string) (string, string) {
 	if len(args) < 2 {
 		log.Fatalln("missing environment name ov vm name")
 	}
@@ -153,6 +598,12 @@ func rmvm(cmd *cobra.Command, args []string) {
 		log.Fatalln("invalid vm name")
 	}
 
+	return envName, vmName
+}
+
+// loadEnvConfig parses the terraform configuration of an existing environment
+// and returns it along with the terraform directory
+func loadEnvConfig(envName string) (string, terraform.Config) {
 	envPath, err := environmentDir(DataDir, envName)
 	if err != nil {
 		log.Fatalln("invalid data directory:", err)
@@ -171,32 +622,92 @@ func rmvm(cmd *cobra.Command, args []string) {
 		log.Fatalln(err)
 	}
 
-	if _, ok := conf.Module.Machines[vmName]; !ok {
-		log.Fatalln("VM not found in the terraform config of the environment")
+	return tfConfigDir, conf
+}
+
+// applyEnvConfig writes the terraform configuration of the environment and
+// applies it
+func applyEnvConfig(tfConfigDir string, conf terraform.Config) error {
+	if err := writeEnvConfig(tfConfigDir, conf); err != nil {
+		return err
 	}
 
-	delete(conf.Module.Machines, vmName)
+	binDir, _ := binaryDir(DataDir)
+	if err := initEnvConfig(binDir, tfConfigDir, conf); err != nil {
+		return err
+	}
 
-	dst, err := os.Create(tfConfigPath)
+	if err := terraform.Apply(binDir, tfConfigDir); err != nil {
+		// the network may have been updated before the failure
+		if err := syncDNSTXT(conf.Module); err != nil {
+			log.Println("warning:", err)
+		}
+		return err
+	}
+
+	if err := syncDNSTXT(conf.Module); err != nil {
+		log.Println("warning:", err)
+	}
+
+	return nil
+}
+
+// initEnvConfig runs terraform init again in the terraform directory of the
+// environment when the module requires providers that were not installed at
+// its creation
+func initEnvConfig(binDir string, tfConfigDir string, conf terraform.Config) error {
+	need, err := terraform.InitNeeded(tfConfigDir, conf.Module.Source)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
 
-	if err := terraform.WriteModuleConfig(dst, conf); err != nil {
-		dst.Close()
-		log.Fatalln(err)
+	if !need {
+		return nil
 	}
 
-	dst.Close()
+	log.Println("installing the providers required by the module of the environment")
+	return terraform.Init(binDir, tfConfigDir)
+}
 
-	binDir, _ := binaryDir(DataDir)
-	if err := terraform.Apply(binDir, tfConfigDir); err != nil {
-		log.Fatalln(err)
+// syncDNSTXT adds back the TXT records of the environment to its network,
+// terraform does not know about them. They stay in the configuration of the
+// environment when it fails, the next apply adds them back.
+func syncDNSTXT(mod terraform.Module) error {
+	txts := make([]hv.DnsTXT, 0)
+	for _, r := range mod.DNSRecords {
+		if r.Type == "txt" {
+			txts = append(txts, hv.DnsTXT{Name: txtName(mod, r), Value: r.Value})
+		}
 	}
 
-	// Force dnsmasq to re-read the addn-hosts file so that we can resolv
-	// the name of the vm
-	if err := restartDnsmasq(); err != nil {
-		log.Fatalln(err)
+	if len(txts) == 0 {
+		return nil
+	}
+
+	h, err := hv.NewHypervisor(Uri)
+	if err != nil {
+		return err
 	}
+	defer h.Close()
+
+	if err := hv.SyncNetworkTXTs(h, orDefault(mod.NetworkName, "carcass"), txts); err != nil {
+		return fmt.Errorf("TXT records missing from the network: %w", err)
+	}
+
+	return nil
+}
+
+// writeEnvConfig writes the terraform configuration of the environment
+func writeEnvConfig(tfConfigDir string, conf terraform.Config) error {
+	dst, err := os.Create(filepath.Join(tfConfigDir, "main.tf"))
+	if err != nil {
+		return err
+	}
+
+	if err := terraform.WriteModuleConfig(dst, conf); err != nil {
+		dst.Close()
+		return err
+	}
+
+	return dst.Close()
 }
@@ -0,0 +1,216 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/orgrim/carcass/hv"
+	"github.com/orgrim/carcass/infra"
+	"github.com/orgrim/carcass/terraform"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	setVmCmd.Flags().IntVar(&setVcpu, "vcpu", 0, "Number of vCPUs")
+	setVmCmd.Flags().IntVar(&setMemory, "ram", 0, "Amount of RAM in Megabytes")
+	setVmCmd.Flags().StringVar(&setDataSize, "data", "", "Size of the data disk, e.g. 20G or 512M, in Gigabytes without unit, it can only grow")
+	setVmCmd.Flags().IntVar(&setDataDisk, "data-disk", 1, "Number of the data disk to grow, starting at 1")
+	setVmCmd.Flags().DurationVarP(&setTimeout, "timeout", "t", 2*time.Minute, "Time to wait for the VM to shutdown")
+	setVmCmd.Flags().BoolVarP(&forceCapacity, "force", "f", false, "Resize the VM even if the host lacks resources")
+	vmCmd.AddCommand(setVmCmd)
+}
+
+var (
+	setVmCmd = &cobra.Command{
+		Use:   "set <env> <shortname> [options]",
+		Short: "Resize a VM of an environment",
+		Long: `Change the number of vCPUs, the memory or the size of the data disk of a VM.
+The VM is shutdown and restarted when the vCPUs or the memory change, the data
+disk is grown online when possible`,
+		Run: setvm,
+	}
+
+	setVcpu     int
+	setMemory   int
+	setDataSize string
+	setDataDisk int
+	setTimeout  time.Duration
+)
+
+func setvm(cmd *cobra.Command, args []string) {
+	envName, vmName := envVmArgs(args)
+
+	tfConfigDir, conf := loadEnvConfig(envName)
+
+	m, ok := conf.Module.Machines[vmName]
+	if !ok {
+		log.Fatalln("VM not found in the terraform config of the environment")
+	}
+
+	newM := m
+	if setVcpu > 0 {
+		newM.Vcpus = setVcpu
+	}
+	if setMemory > 0 {
+		newM.Memory = setMemory
+	}
+
+	if err := terraform.CheckCPUOptions(newM.CpuMode, newM.CpuModel, newM.Sockets, newM.Cores, newM.Threads, newM.Vcpus); err != nil {
+		log.Fatalln(err)
+	}
+
+	// work on a copy of the disks to keep the current sizes in m
+	newM.Disks = append([]terraform.DataDisk{}, m.Disks...)
+
+	n := setDataDisk - 1
+	if setDataSize != "" {
+		if n < 0 || n >= len(m.Disks) {
+			log.Fatalf("data disk %d not found, the VM has %d data disks", setDataDisk, len(m.Disks))
+		}
+
+		size, err := parseSize(setDataSize)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		newM.Disks[n].Size = size
+		if newM.Disks[n].Size < m.Disks[n].Size {
+			log.Fatalln("the data disk cannot shrink")
+		}
+	}
+
+	growDisk := setDataSize != "" && newM.Disks[n].Size != m.Disks[n].Size
+	if newM.Vcpus == m.Vcpus && newM.Memory == m.Memory && !growDisk {
+		log.Println("nothing to change")
+		return
+	}
+
+	need := infra.Resources{Vcpus: newM.Vcpus}
+	if newM.Memory > m.Memory {
+		need.Memory = int64(newM.Memory-m.Memory) * 1024 * 1024
+	}
+	if growDisk {
+		need.Disks = diskNeeds(conf.Module, []terraform.DataDisk{{
+			Size: newM.Disks[n].Size - m.Disks[n].Size,
+			Pool: m.Disks[n].Pool,
+		}})
+	}
+	h, err := hv.NewHypervisor(Uri)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer h.Close()
+
+	checkCapacity(&h, need)
+
+	env, err := lookupEnvironment(&h, envName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	domName := fmt.Sprintf("%s.%s", vmName, conf.Module.Domain)
+
+	var dom *hv.Domain
+	for i, d := range env.Infra.Machines {
+		if d.Name == domName {
+			dom = &env.Infra.Machines[i]
+			break
+		}
+	}
+
+	if dom == nil {
+		log.Fatalln("VM not found on the hypervisor")
+	}
+
+	restart := false
+	setResources := newM.Vcpus != m.Vcpus || newM.Memory != m.Memory
+
+	// abort restores the previous vcpus and memory and starts the VM again
+	// when it was shutdown, so that a failure does not leave it powered
+	// off with a partial change
+	abort := func(err error) {
+		if setResources {
+			if rerr := hv.SetDomainResources(h, domName, m.Vcpus, m.Memory); rerr != nil {
+				log.Printf("could not restore the vcpus and memory of %s: %s", domName, rerr)
+			}
+		}
+
+		if !restart {
+			log.Fatalln(err)
+		}
+
+		if serr := env.Infra.Start(domName); serr != nil {
+			log.Fatalf("%s, could not start %s again: %s", err, domName, serr)
+		}
+		log.Fatalf("%s, %s started again with its previous resources", err, domName)
+	}
+
+	if setResources {
+		if dom.Status {
+			if err := env.Infra.ShutdownWait(domName, setTimeout, false); err != nil {
+				log.Fatalln(err)
+			}
+			restart = true
+		}
+
+		if err := hv.SetDomainResources(h, domName, newM.Vcpus, newM.Memory); err != nil {
+			abort(err)
+		}
+	}
+
+	if growDisk {
+		volName := terraform.DataVolumeName(vmName, conf.Module.Domain, n)
+
+		var data *hv.Disk
+		for i, disk := range dom.Disks {
+			if disk.Source.Volume == volName {
+				data = &dom.Disks[i]
+				break
+			}
+		}
+
+		if data == nil {
+			abort(fmt.Errorf("could not find the data disk %s of the VM", volName))
+		}
+
+		size := newM.Disks[n].Size
+		online := false
+		if dom.Status && !restart {
+			err := hv.ResizeDomainDisk(h, domName, data.Device.Dev, size)
+			if err == nil {
+				online = true
+				log.Printf("data disk grown online, the partition and filesystem must be extended inside %s", domName)
+			} else {
+				log.Printf("could not grow the data disk online, restarting: %s", err)
+				if err := env.Infra.ShutdownWait(domName, setTimeout, false); err != nil {
+					log.Fatalln(err)
+				}
+				restart = true
+			}
+		}
+
+		if !online {
+			if err := hv.ResizeVolume(h, data.Source.Pool, data.Source.Volume, size); err != nil {
+				abort(err)
+			}
+		}
+	}
+
+	if restart {
+		if err := env.Infra.Start(domName); err != nil {
+			log.Println(err)
+		}
+	}
+
+	// Terraform ignores the changes of vcpu, memory and data size, which
+	// are done above, but the configuration must match
+	conf.Module.Machines[vmName] = newM
+	if err := applyEnvConfig(tfConfigDir, conf); err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/orgrim/carcass/hv"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	showVmCmd.Flags().BoolVar(&showJson, "json", false, "output in JSON")
+	vmCmd.AddCommand(showVmCmd)
+}
+
+var (
+	showVmCmd = &cobra.Command{
+		Use:   "show <env> <shortname>",
+		Short: "Show the details of a VM",
+		Long: `Show the definition and the state of a VM: its disks with their backing
+image and allocation, its interfaces with their addresses, the CPU time and
+the cloud-init ISO. The hostname, OS and addresses come from the guest agent
+when it is connected. The uptime is the time since the domain was started,
+a reboot inside the guest does not reset it, it is only known when the
+hypervisor is local`,
+		Run: showvm,
+	}
+
+	showJson bool
+)
+
+func showvm(cmd *cobra.Command, args []string) {
+	envName, vmName := envVmArgs(args)
+
+	h, err := hv.NewHypervisor(Uri)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer h.Close()
+
+	env, err := lookupEnvironment(&h, envName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	details, err := hv.LookupDomainDetails(h, fmt.Sprintf("%s.%s", vmName, env.Domain))
+	if err != nil {
+		h.Close()
+		log.Fatalln(err)
+	}
+
+	// VMs have static addresses, they are not in the leases of the
+	// network, complete with the configuration
+	if m, ok := env.Infra.Config.Module.Machines[vmName]; ok {
+		for i, iface := range details.Ifaces {
+			if len(iface.Addresses) > 0 {
+				continue
+			}
+
+			if iface.Network == env.Infra.Network.Name {
+				details.Ifaces[i].Addresses = append(details.Ifaces[i].Addresses, m.IPAddress)
+				if m.IPAddress6 != "" {
+					details.Ifaces[i].Addresses = append(details.Ifaces[i].Addresses, m.IPAddress6)
+				}
+				continue
+			}
+
+			for _, nic := range m.Nics {
+				if nic.Mac == iface.Mac {
+					details.Ifaces[i].Addresses = append(details.Ifaces[i].Addresses, nic.IPAddress)
+				}
+			}
+		}
+	}
+
+	if showJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(details); err != nil {
+			h.Close()
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	fmt.Print(details)
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/orgrim/carcass/environment"
+	"github.com/orgrim/carcass/hv"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	waitCmd.Flags().DurationVarP(&waitTimeout, "timeout", "t", 10*time.Minute, "maximum time to wait")
+	rootCmd.AddCommand(waitCmd)
+}
+
+var (
+	waitCmd = &cobra.Command{
+		Use:   "wait <env> [vm...]",
+		Short: "Wait for VMs to be ready",
+		Long: `Wait until cloud-init has finished on the VMs of the environment, all of
+them when none is given. Cloud-init phones home to carcass listening on the
+gateway address of the network, or on the address of the host given to
+create in bridge mode. Since it does it only once, the status of
+cloud-init is also checked with SSH, for the VMs that finished before`,
+		Run: wait,
+	}
+
+	waitTimeout time.Duration
+)
+
+func wait(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatalln("missing environment name")
+	}
+
+	envName := args[0]
+	if hasForbiddenChars(envName) || len(envName) == 0 {
+		log.Fatalln("invalid environment name")
+	}
+
+	h, err := hv.NewHypervisor(Uri)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer h.Close()
+
+	env, err := lookupEnvironment(&h, envName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	names := make([]string, 0, len(args)-1)
+	for _, vmName := range args[1:] {
+		if hasForbiddenChars(vmName) || len(vmName) == 0 {
+			log.Fatalln("invalid vm name")
+		}
+		names = append(names, fmt.Sprintf("%s.%s", vmName, env.Domain))
+	}
+
+	key := sshKey(env)
+	check := func(name string) bool {
+		return cloudInitDone(env, key, strings.TrimSuffix(name, "."+env.Domain))
+	}
+
+	statuses, err := env.Infra.WaitReady(names, waitTimeout, check)
+
+	width := 0
+	for _, s := range statuses {
+		if len(s.Name) > width {
+			width = len(s.Name)
+		}
+	}
+
+	for _, s := range statuses {
+		if s.Ready {
+			fmt.Printf("%-*s  %-15s  ready (%s)\n", width, s.Name, s.Address, s.Elapsed.Round(time.Second))
+		} else {
+			fmt.Printf("%-*s  %-15s  not ready\n", width, s.Name, s.Address)
+		}
+	}
+
+	if err != nil {
+		log.Println(err)
+		h.Close()
+		os.Exit(1)
+	}
+}
+
+// cloudInitDone checks with SSH if cloud-init has finished on a VM
+func cloudInitDone(env *environment.Environment, key string, vmName string) bool {
+	target, err := sshTarget(env, vmName)
+	if err != nil {
+		return false
+	}
+
+	sshArgs := append(sshOptions(key), "-o", "BatchMode=yes", "-o", "ConnectTimeout=5", target, "--", "cloud-init", "status")
+	out, _ := exec.Command("ssh", sshArgs...).Output()
+
+	// cloud-init status exits with an error when it has failed, it has
+	// finished anyway
+	status := strings.TrimSpace(string(out))
+	switch status {
+	case "status: done":
+		return true
+	case "status: error":
+		log.Printf("cloud-init has finished with errors on %s", vmName)
+		return true
+	}
+
+	return false
+}
@@ -6,6 +6,8 @@ package environment
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/orgrim/carcass/hv"
 	"github.com/orgrim/carcass/infra"
@@ -34,7 +36,11 @@ func (e Environment) String() string {
 		s += fmt.Sprintf(" (%s)\n", e.Description)
 	}
 
-	s += fmt.Sprintf("  Network: %s  %s\n", e.Infra.Network.Name, e.Infra.Network.Address)
+	s += fmt.Sprintf("  Network: %s  %s", e.Infra.Network.Name, e.Infra.Network.Address)
+	if e.Infra.Network.Address6.Address != "" {
+		s += fmt.Sprintf("  %s", e.Infra.Network.Address6)
+	}
+	s += fmt.Sprintf("  %s\n", e.Infra.Network.Mode())
 	s += "  Machines:\n"
 
 	width := 0
@@ -53,10 +59,22 @@ func (e Environment) String() string {
 
 		s += fmt.Sprintf("  %s", e.Infra.Network.LookupDnsHostByName(d.Name))
 
+		data := make([]string, 0)
 		for _, disk := range d.Disks {
 			if disk.Source.BackingVolName != "" {
 				s += fmt.Sprintf("  %s", infra.ImageNameFromVolume(disk.Source.BackingVolName))
 			}
+			if strings.HasPrefix(disk.Source.Volume, "data_volume") {
+				data = append(data, hv.SizePretty(disk.Capacity))
+			}
+		}
+
+		if len(data) > 0 {
+			s += fmt.Sprintf("  data: %s", strings.Join(data, ", "))
+		}
+
+		if len(d.Guest) > 0 {
+			s += fmt.Sprintf("  guest: %s", strings.Join(d.Guest, ", "))
 		}
 
 		if d.Status {
@@ -101,10 +119,16 @@ func (e *Environment) Create() error {
 	return nil
 }
 
-func (e *Environment) Start() {
-	e.Infra.StartAll()
+func (e *Environment) Start(timeout time.Duration) error {
+	return e.Infra.StartAll(timeout)
 }
 
 func (e *Environment) Stop(force bool) {
 	e.Infra.StopAll(force)
 }
+
+// StopWait stops all VM of the environment and waits for them to be down,
+// see infra.StopAllWait
+func (e *Environment) StopWait(timeout time.Duration, destroy bool) []infra.StopStatus {
+	return e.Infra.StopAllWait(timeout, destroy)
+}
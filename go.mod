@@ -6,5 +6,6 @@ require (
 	github.com/hashicorp/hcl/v2 v2.10.0
 	github.com/schollz/progressbar/v3 v3.8.2 // indirect
 	github.com/spf13/cobra v1.2.1
+	github.com/zclconf/go-cty v1.8.0
 	libvirt.org/go/libvirt v1.7005.0
 )
@@ -0,0 +1,126 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	libvirt "libvirt.org/go/libvirt"
+)
+
+// GuestInfo holds what the guest agent running inside a domain reports
+type GuestInfo struct {
+	Hostname  string              `json:"hostname"`
+	OS        string              `json:"os"`
+	Addresses map[string][]string `json:"addresses"` // interface -> addresses with prefix
+}
+
+// LookupGuestInfo queries the guest agent of a running domain for its
+// hostname, OS and IP addresses
+func LookupGuestInfo(h Hypervisor, name string) (GuestInfo, error) {
+	dom, err := h.Conn.LookupDomainByName(name)
+	if err != nil {
+		return GuestInfo{}, fmt.Errorf("could not lookup domain %s: %w", name, err)
+	}
+	defer dom.Free()
+
+	hostname, err := dom.GetHostname(libvirt.DOMAIN_GET_HOSTNAME_AGENT)
+	if err != nil {
+		return GuestInfo{}, fmt.Errorf("could not get hostname from guest agent of %s: %w", name, err)
+	}
+
+	info := GuestInfo{
+		Hostname:  hostname,
+		Addresses: make(map[string][]string),
+	}
+
+	ifaces, err := dom.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT)
+	if err != nil {
+		return GuestInfo{}, fmt.Errorf("could not get addresses from guest agent of %s: %w", name, err)
+	}
+
+	for _, iface := range ifaces {
+		for _, a := range iface.Addrs {
+			if !globalAddress(a.Addr) {
+				continue
+			}
+			info.Addresses[iface.Name] = append(info.Addresses[iface.Name], fmt.Sprintf("%s/%d", a.Addr, a.Prefix))
+		}
+	}
+
+	// guest-get-osinfo is not available on old agents, the OS stays
+	// unknown then
+	out, err := dom.QemuAgentCommand(`{"execute":"guest-get-osinfo"}`, libvirt.DOMAIN_QEMU_AGENT_COMMAND_DEFAULT, 0)
+	if err == nil {
+		var res struct {
+			Return struct {
+				PrettyName string `json:"pretty-name"`
+			} `json:"return"`
+		}
+
+		if err := json.Unmarshal([]byte(out), &res); err == nil {
+			info.OS = res.Return.PrettyName
+		}
+	}
+
+	return info, nil
+}
+
+func guestAddresses(dom *libvirt.Domain) ([]string, error) {
+	ifaces, err := dom.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT)
+	if err != nil {
+		return nil, fmt.Errorf("could not get addresses from guest agent: %w", err)
+	}
+
+	addrs := make([]string, 0)
+	for _, iface := range ifaces {
+		for _, a := range iface.Addrs {
+			if globalAddress(a.Addr) {
+				addrs = append(addrs, a.Addr)
+			}
+		}
+	}
+
+	return addrs, nil
+}
+
+func globalAddress(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && !ip.IsLoopback() && !ip.IsLinkLocalUnicast()
+}
+
+// FreezeFilesystems asks the guest agent of a running domain to freeze all
+// its filesystems, for a consistent copy of its disks
+func FreezeFilesystems(h Hypervisor, name string) error {
+	dom, err := h.Conn.LookupDomainByName(name)
+	if err != nil {
+		return fmt.Errorf("could not lookup domain %s: %w", name, err)
+	}
+	defer dom.Free()
+
+	if err := dom.FSFreeze(nil, 0); err != nil {
+		return fmt.Errorf("could not freeze filesystems of %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// ThawFilesystems asks the guest agent of a running domain to thaw its
+// filesystems, after FreezeFilesystems
+func ThawFilesystems(h Hypervisor, name string) error {
+	dom, err := h.Conn.LookupDomainByName(name)
+	if err != nil {
+		return fmt.Errorf("could not lookup domain %s: %w", name, err)
+	}
+	defer dom.Free()
+
+	if err := dom.FSThaw(nil, 0); err != nil {
+		return fmt.Errorf("could not thaw filesystems of %s: %w", name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,235 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hv
+
+import (
+	"fmt"
+	"time"
+
+	libvirt "libvirt.org/go/libvirt"
+)
+
+// DomainDetails holds everything we know about a domain, from its
+// definition and its runtime state
+type DomainDetails struct {
+	Name      string         `json:"name"`
+	Type      string         `json:"type"`
+	Uuid      string         `json:"uuid"`
+	State     string         `json:"state"`
+	Hostname  string         `json:"hostname,omitempty"` // from the guest agent
+	OS        string         `json:"os,omitempty"`
+	Vcpus     int            `json:"vcpus"`
+	Memory    int64          `json:"memory"` // bytes
+	CpuTime   time.Duration  `json:"cpu_time_ns"`
+	Uptime    time.Duration  `json:"uptime_ns,omitempty"` // since the start of the domain, on a local hypervisor
+	Disks     []DiskDetails  `json:"disks"`
+	Ifaces    []IfaceDetails `json:"interfaces"`
+	CloudInit string         `json:"cloud_init,omitempty"`
+}
+
+// DiskDetails describes a disk of a domain
+type DiskDetails struct {
+	Device       string `json:"device"`
+	Bus          string `json:"bus"`
+	Kind         string `json:"kind"`
+	Pool         string `json:"pool,omitempty"`
+	Volume       string `json:"volume,omitempty"`
+	Path         string `json:"path,omitempty"`
+	BackingImage string `json:"backing_image,omitempty"`
+	Capacity     int64  `json:"capacity"`
+	Allocation   int64  `json:"allocation"`
+}
+
+// IfaceDetails describes a network interface of a domain
+type IfaceDetails struct {
+	Device    string   `json:"device"`
+	Mac       string   `json:"mac"`
+	Network   string   `json:"network"`
+	Bridge    string   `json:"bridge,omitempty"`
+	Addresses []string `json:"addresses"`
+}
+
+// LookupDomainDetails gathers the details of a domain. The runtime
+// information is only available when the domain is running.
+func LookupDomainDetails(h Hypervisor, name string) (DomainDetails, error) {
+	dom, err := h.Conn.LookupDomainByName(name)
+	if err != nil {
+		return DomainDetails{}, fmt.Errorf("could not lookup domain %s: %w", name, err)
+	}
+	defer dom.Free()
+
+	desc, err := dom.GetXMLDesc(0)
+	if err != nil {
+		return DomainDetails{}, fmt.Errorf("could not get XML description of the domain: %w", err)
+	}
+
+	domain, err := parseDomainXMLDesc(desc)
+	if err != nil {
+		return DomainDetails{}, err
+	}
+
+	fillDiskVolumes(h, &domain)
+
+	info, err := dom.GetInfo()
+	if err != nil {
+		return DomainDetails{}, fmt.Errorf("could not get information on domain %s: %w", name, err)
+	}
+
+	d := newDomainDetails(domain)
+	d.State = stateName(info.State)
+	d.Memory = int64(info.MaxMem) * 1024
+
+	active := info.State == libvirt.DOMAIN_RUNNING || info.State == libvirt.DOMAIN_PAUSED || info.State == libvirt.DOMAIN_BLOCKED
+
+	var leases []libvirt.DomainInterface
+	if active {
+		d.CpuTime = time.Duration(info.CpuTime)
+
+		// the uptime is the one of the qemu process, a reboot of the
+		// guest does not reset it. The process is only visible on the
+		// local host, and the guest agent has no way to tell the
+		// uptime without running a command in the guest.
+		if h.IsLocal() {
+			if start, err := domainStartTime(name); err == nil {
+				d.Uptime = time.Since(start).Round(time.Second)
+			}
+		}
+
+		// prefer what the guest agent reports, errors are not fatal, we
+		// only miss the addresses. Calling an agent that is not
+		// connected blocks until the timeout.
+		agent := domain.AgentConnected()
+		if agent {
+			leases, err = dom.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT)
+		}
+		if !agent || err != nil {
+			leases, _ = dom.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE)
+		}
+
+		if agent {
+			if guest, err := LookupGuestInfo(h, name); err == nil {
+				d.Hostname = guest.Hostname
+				d.OS = guest.OS
+			}
+		}
+	}
+
+	for i, iface := range d.Ifaces {
+		for _, l := range leases {
+			if l.Hwaddr != iface.Mac {
+				continue
+			}
+			for _, a := range l.Addrs {
+				if !globalAddress(a.Addr) {
+					continue
+				}
+				d.Ifaces[i].Addresses = append(d.Ifaces[i].Addresses, fmt.Sprintf("%s/%d", a.Addr, a.Prefix))
+			}
+		}
+	}
+
+	return d, nil
+}
+
+// newDomainDetails gives the details found in the definition of a domain
+func newDomainDetails(domain Domain) DomainDetails {
+	d := DomainDetails{
+		Name:   domain.Name,
+		Type:   domain.Type,
+		Uuid:   domain.Uuid,
+		Vcpus:  domain.Vcpu,
+		Memory: domain.Memory.Bytes(),
+		Disks:  make([]DiskDetails, 0, len(domain.Disks)),
+		Ifaces: make([]IfaceDetails, 0, len(domain.Ifaces)),
+	}
+
+	for _, disk := range domain.Disks {
+		dd := DiskDetails{
+			Device:       disk.Device.Dev,
+			Bus:          disk.Device.Bus,
+			Kind:         disk.Kind,
+			Pool:         disk.Source.Pool,
+			Volume:       disk.Source.Volume,
+			Path:         disk.Source.File,
+			BackingImage: disk.Source.BackingVolName,
+			Capacity:     disk.Capacity,
+			Allocation:   disk.Allocation,
+		}
+
+		// the terraform provider attaches the cloud-init ISO as a cdrom
+		if disk.Kind == "cdrom" && d.CloudInit == "" {
+			if dd.Volume != "" {
+				d.CloudInit = dd.Volume
+			} else {
+				d.CloudInit = dd.Path
+			}
+		}
+
+		d.Disks = append(d.Disks, dd)
+	}
+
+	for _, iface := range domain.Ifaces {
+		d.Ifaces = append(d.Ifaces, IfaceDetails{
+			Device:    iface.Device.Dev,
+			Mac:       iface.Mac.Address,
+			Network:   iface.Source.Network,
+			Bridge:    iface.Source.Bridge,
+			Addresses: make([]string, 0),
+		})
+	}
+
+	return d
+}
+
+func (d DomainDetails) String() string {
+	s := fmt.Sprintf("Domain: %s (%s) %s\n", d.Name, d.Type, d.Uuid)
+	if d.State != "" {
+		s += fmt.Sprintf("  state: %s", d.State)
+		if d.Uptime > 0 {
+			s += fmt.Sprintf(", uptime: %s", d.Uptime)
+		}
+		if d.CpuTime > 0 {
+			s += fmt.Sprintf(", cpu time: %s", d.CpuTime.Round(time.Millisecond))
+		}
+		s += "\n"
+	}
+	if d.Hostname != "" {
+		s += fmt.Sprintf("  guest: %s", d.Hostname)
+		if d.OS != "" {
+			s += fmt.Sprintf(" (%s)", d.OS)
+		}
+		s += "\n"
+	}
+	s += fmt.Sprintf("  cpu: %d, mem: %s\n", d.Vcpus, SizePretty(d.Memory))
+	s += "  disks:\n"
+	for _, disk := range d.Disks {
+		switch {
+		case disk.Volume != "":
+			s += fmt.Sprintf("   - %s: %s/%s - volume: %s::%s (%s, allocated %s)", disk.Kind, disk.Bus, disk.Device, disk.Pool, disk.Volume, SizePretty(disk.Capacity), SizePretty(disk.Allocation))
+			if disk.BackingImage != "" {
+				s += fmt.Sprintf(" - image: %s", disk.BackingImage)
+			}
+			s += "\n"
+		default:
+			s += fmt.Sprintf("   - %s: %s/%s - path: %s\n", disk.Kind, disk.Bus, disk.Device, disk.Path)
+		}
+	}
+	s += "  interfaces:\n"
+	for _, iface := range d.Ifaces {
+		s += fmt.Sprintf("   - %s %s net: %s", iface.Device, iface.Mac, iface.Network)
+		if iface.Bridge != "" {
+			s += fmt.Sprintf(" bridge: %s", iface.Bridge)
+		}
+		for _, a := range iface.Addresses {
+			s += " " + a
+		}
+		s += "\n"
+	}
+	if d.CloudInit != "" {
+		s += fmt.Sprintf("  cloud-init: %s\n", d.CloudInit)
+	}
+
+	return s
+}
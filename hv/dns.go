@@ -0,0 +1,83 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hv
+
+import (
+	"encoding/xml"
+	"fmt"
+	libvirt "libvirt.org/go/libvirt"
+)
+
+// A DnsTXT is a TXT record of the DNS of a network
+type DnsTXT struct {
+	XMLName xml.Name `xml:"txt"`
+	Name    string   `xml:"name,attr"`
+	Value   string   `xml:"value,attr"`
+}
+
+// AddNetworkTXT adds a TXT record to the DNS of a network, the change is
+// live when the network is active and kept in its definition
+func AddNetworkTXT(h Hypervisor, network string, name string, value string) error {
+	return updateNetworkTXT(h, network, libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, DnsTXT{Name: name, Value: value})
+}
+
+// RemoveNetworkTXT removes a TXT record from the DNS of a network
+func RemoveNetworkTXT(h Hypervisor, network string, name string, value string) error {
+	return updateNetworkTXT(h, network, libvirt.NETWORK_UPDATE_COMMAND_DELETE, DnsTXT{Name: name, Value: value})
+}
+
+// SyncNetworkTXTs adds the TXT records missing from the DNS of a network.
+// The terraform provider does not manage them, they are lost when it
+// recreates or updates the network.
+func SyncNetworkTXTs(h Hypervisor, network string, txts []DnsTXT) error {
+	n, err := LookupNetwork(h, network)
+	if err != nil {
+		return err
+	}
+
+	for _, txt := range txts {
+		found := false
+		for _, t := range n.TXTs {
+			if t.Name == txt.Name && t.Value == txt.Value {
+				found = true
+				break
+			}
+		}
+
+		if found {
+			continue
+		}
+
+		if err := updateNetworkTXT(h, network, libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, txt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func updateNetworkTXT(h Hypervisor, network string, command libvirt.NetworkUpdateCommand, txt DnsTXT) error {
+	net, err := h.Conn.LookupNetworkByName(network)
+	if err != nil {
+		return fmt.Errorf("could not lookup network: %w", err)
+	}
+	defer net.Free()
+
+	desc, err := xml.Marshal(txt)
+	if err != nil {
+		return fmt.Errorf("could not build the XML of the TXT record: %w", err)
+	}
+
+	flags := libvirt.NETWORK_UPDATE_AFFECT_CONFIG
+	if active, err := net.IsActive(); err == nil && active {
+		flags |= libvirt.NETWORK_UPDATE_AFFECT_LIVE
+	}
+
+	if err := net.Update(command, libvirt.NETWORK_SECTION_DNS_TXT, -1, string(desc), flags); err != nil {
+		return fmt.Errorf("could not update the TXT records of network %s: %w", network, err)
+	}
+
+	return nil
+}
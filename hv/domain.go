@@ -0,0 +1,160 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hv
+
+import (
+	"fmt"
+
+	libvirt "libvirt.org/go/libvirt"
+)
+
+// SetDomainResources changes the number of vCPUs and the memory in MiB of the
+// persistent definition of the domain, they are used on next boot
+func SetDomainResources(h Hypervisor, name string, vcpus int, memory int) error {
+	dom, err := h.Conn.LookupDomainByName(name)
+	if err != nil {
+		return fmt.Errorf("could not lookup domain %s: %w", name, err)
+	}
+	defer dom.Free()
+
+	if vcpus > 0 {
+		max, err := dom.GetVcpusFlags(libvirt.DOMAIN_VCPU_CONFIG | libvirt.DOMAIN_VCPU_MAXIMUM)
+		if err != nil {
+			return fmt.Errorf("could not get vcpus of domain %s: %w", name, err)
+		}
+
+		// the current count must stay below the maximum, the order of
+		// the changes depends on growing or shrinking
+		flags := []libvirt.DomainVcpuFlags{
+			libvirt.DOMAIN_VCPU_CONFIG | libvirt.DOMAIN_VCPU_MAXIMUM,
+			libvirt.DOMAIN_VCPU_CONFIG,
+		}
+		if vcpus < int(max) {
+			flags[0], flags[1] = flags[1], flags[0]
+		}
+
+		for _, f := range flags {
+			if err := dom.SetVcpusFlags(uint(vcpus), f); err != nil {
+				return fmt.Errorf("could not set vcpus of domain %s: %w", name, err)
+			}
+		}
+	}
+
+	if memory > 0 {
+		kib := uint64(memory) * 1024
+
+		flags := []libvirt.DomainMemoryModFlags{
+			libvirt.DOMAIN_MEM_CONFIG | libvirt.DOMAIN_MEM_MAXIMUM,
+			libvirt.DOMAIN_MEM_CONFIG,
+		}
+
+		info, err := dom.GetInfo()
+		if err != nil {
+			return fmt.Errorf("could not get info of domain %s: %w", name, err)
+		}
+
+		if kib < info.MaxMem {
+			flags[0], flags[1] = flags[1], flags[0]
+		}
+
+		for _, f := range flags {
+			if err := dom.SetMemoryFlags(kib, f); err != nil {
+				return fmt.Errorf("could not set memory of domain %s: %w", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ResizeDomainDisk grows the disk of an active domain online. The disk is the
+// target device of the domain, e.g. "sdb".
+func ResizeDomainDisk(h Hypervisor, name string, disk string, capacity int64) error {
+	dom, err := h.Conn.LookupDomainByName(name)
+	if err != nil {
+		return fmt.Errorf("could not lookup domain %s: %w", name, err)
+	}
+	defer dom.Free()
+
+	err = dom.BlockResize(disk, uint64(capacity), libvirt.DOMAIN_BLOCK_RESIZE_BYTES)
+	if err != nil {
+		return fmt.Errorf("could not resize disk %s of domain %s: %w", disk, name, err)
+	}
+
+	return nil
+}
+
+// ControlDomain runs a lifecycle action on a domain: "start", "shutdown",
+// "destroy", "reboot", "reset", "pause" or "resume"
+func ControlDomain(h Hypervisor, name string, action string) error {
+	dom, err := h.Conn.LookupDomainByName(name)
+	if err != nil {
+		return fmt.Errorf("could not lookup domain %s: %w", name, err)
+	}
+	defer dom.Free()
+
+	switch action {
+	case "start":
+		err = dom.Create()
+	case "shutdown":
+		err = dom.Shutdown()
+	case "destroy":
+		err = dom.Destroy()
+	case "reboot":
+		err = dom.Reboot(libvirt.DOMAIN_REBOOT_DEFAULT)
+	case "reset":
+		err = dom.Reset(0)
+	case "pause":
+		err = dom.Suspend()
+	case "resume":
+		err = dom.Resume()
+	default:
+		return fmt.Errorf("unsupported action on domain: %s", action)
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not %s domain %s: %w", action, name, err)
+	}
+
+	return nil
+}
+
+// DomainState gives the state of a domain as a string, e.g. "running" or
+// "shutoff"
+func DomainState(h Hypervisor, name string) (string, error) {
+	dom, err := h.Conn.LookupDomainByName(name)
+	if err != nil {
+		return "", fmt.Errorf("could not lookup domain %s: %w", name, err)
+	}
+	defer dom.Free()
+
+	state, _, err := dom.GetState()
+	if err != nil {
+		return "", fmt.Errorf("could not get state of domain %s: %w", name, err)
+	}
+
+	return stateName(state), nil
+}
+
+func stateName(state libvirt.DomainState) string {
+	switch state {
+	case libvirt.DOMAIN_RUNNING:
+		return "running"
+	case libvirt.DOMAIN_BLOCKED:
+		return "blocked"
+	case libvirt.DOMAIN_PAUSED:
+		return "paused"
+	case libvirt.DOMAIN_SHUTDOWN:
+		return "shutting down"
+	case libvirt.DOMAIN_SHUTOFF:
+		return "shutoff"
+	case libvirt.DOMAIN_CRASHED:
+		return "crashed"
+	case libvirt.DOMAIN_PMSUSPENDED:
+		return "suspended"
+	default:
+		return "unknown"
+	}
+}
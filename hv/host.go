@@ -0,0 +1,280 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hv
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HostInfo holds the resources of the hypervisor host
+type HostInfo struct {
+	Cpus       int
+	Memory     int64 // bytes
+	FreeMemory int64 // bytes
+}
+
+// LookupHostInfo gets the number of CPUs and the memory of the hypervisor host
+func LookupHostInfo(h Hypervisor) (HostInfo, error) {
+	node, err := h.Conn.GetNodeInfo()
+	if err != nil {
+		return HostInfo{}, fmt.Errorf("could not get node info: %w", err)
+	}
+
+	free, err := h.Conn.GetFreeMemory()
+	if err != nil {
+		return HostInfo{}, fmt.Errorf("could not get free memory: %w", err)
+	}
+
+	info := HostInfo{
+		Cpus:       int(node.Cpus),
+		Memory:     int64(node.Memory) * 1024, // node memory is in KiB
+		FreeMemory: int64(free),
+	}
+
+	return info, nil
+}
+
+// NestedVirtEnabled tells if the kvm module of the local host allows nested
+// virtualization, it is meaningless for a remote hypervisor
+func NestedVirtEnabled() bool {
+	for _, mod := range []string{"kvm_intel", "kvm_amd"} {
+		v, err := os.ReadFile(fmt.Sprintf("/sys/module/%s/parameters/nested", mod))
+		if err != nil {
+			continue
+		}
+
+		switch strings.TrimSpace(string(v)) {
+		case "Y", "1":
+			return true
+		}
+	}
+
+	return false
+}
+
+// clockTicks is the unit of the times of /proc/<pid>/stat, USER_HZ is 100 on
+// all the architectures supported by Linux
+const clockTicks = 100
+
+// domainStartTime gives when the qemu process of a running domain was
+// started, from /proc of the local host. It is meaningless for a remote
+// hypervisor.
+func domainStartTime(name string) (time.Time, error) {
+	pid := qemuPid(name)
+	if pid == 0 {
+		return time.Time{}, fmt.Errorf("could not find the qemu process of %s", name)
+	}
+
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not read the status of the qemu process of %s: %w", name, err)
+	}
+
+	// the command name may contain spaces and parentheses, the fields
+	// are counted after its closing parenthesis, starttime is the 22nd
+	i := strings.LastIndex(string(stat), ")")
+	if i == -1 {
+		return time.Time{}, fmt.Errorf("invalid status of the qemu process of %s", name)
+	}
+
+	fields := strings.Fields(string(stat)[i+1:])
+	if len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("invalid status of the qemu process of %s", name)
+	}
+
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid start time of the qemu process of %s: %w", name, err)
+	}
+
+	boot, err := bootTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return boot.Add(time.Duration(ticks) * time.Second / clockTicks), nil
+}
+
+// qemuPid finds the qemu process of a domain, libvirt gives its name with
+// -name guest=<name>,... on the command line. It returns 0 when not found.
+func qemuPid(name string) int {
+	paths, _ := filepath.Glob("/proc/[0-9]*/cmdline")
+	for _, path := range paths {
+		cmdline, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		args := strings.Split(string(cmdline), "\x00")
+		for i := 0; i < len(args)-1; i++ {
+			if args[i] != "-name" {
+				continue
+			}
+
+			v := args[i+1]
+			if v == name || strings.HasPrefix(v, "guest="+name+",") || v == "guest="+name {
+				pid, _ := strconv.Atoi(filepath.Base(filepath.Dir(path)))
+				return pid
+			}
+		}
+	}
+
+	return 0
+}
+
+// bootTime reads when the local host has booted from /proc/stat
+func bootTime() (time.Time, error) {
+	stat, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not read /proc/stat: %w", err)
+	}
+
+	for _, line := range strings.Split(string(stat), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "btime" {
+			secs, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid boot time in /proc/stat: %w", err)
+			}
+			return time.Unix(secs, 0), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("could not find the boot time in /proc/stat")
+}
+
+// FindOVMF gives the path of the OVMF UEFI firmware on the hypervisor, with
+// Secure Boot support when secure is true. It is taken from the loaders
+// listed in the domain capabilities, libvirt knows the template of the UEFI
+// variables that goes with each of them.
+func FindOVMF(h Hypervisor, secure bool) (string, error) {
+	// Secure Boot needs the SMM of the q35 machine, firmwares with it
+	// are not listed for the default machine
+	machine := ""
+	if secure {
+		machine = "q35"
+	}
+
+	desc, err := h.Conn.GetDomainCapabilities("", "x86_64", machine, "kvm", 0)
+	if err != nil {
+		return "", fmt.Errorf("could not get the domain capabilities of the hypervisor: %w", err)
+	}
+
+	caps := domainCapabilities{}
+	if err := xml.Unmarshal([]byte(desc), &caps); err != nil {
+		return "", fmt.Errorf("could not parse the domain capabilities of the hypervisor: %w", err)
+	}
+
+	if path := selectOVMF(caps.Loaders, secure); path != "" {
+		return path, nil
+	}
+
+	if secure {
+		return "", fmt.Errorf("the hypervisor does not report an OVMF firmware with Secure Boot, is ovmf installed on it?")
+	}
+
+	return "", fmt.Errorf("the hypervisor does not report an OVMF firmware, is ovmf installed on it?")
+}
+
+// selectOVMF picks the first plain OVMF firmware among the paths of loaders,
+// with or without Secure Boot
+func selectOVMF(loaders []string, secure bool) string {
+	for _, p := range loaders {
+		name := strings.ToLower(filepath.Base(p))
+		if !strings.Contains(name, "ovmf") && !strings.Contains(p, "edk2") {
+			continue
+		}
+
+		// confidential computing builds do not boot regular VMs
+		if strings.Contains(name, "sev") || strings.Contains(name, "tdx") {
+			continue
+		}
+
+		sb := strings.Contains(name, "secboot") || strings.Contains(name, ".ms.") || strings.Contains(name, "secure")
+		if sb == secure {
+			return p
+		}
+	}
+
+	return ""
+}
+
+// virtiofsdPaths lists the usual locations of virtiofsd, by distribution
+var virtiofsdPaths = []string{
+	"/usr/libexec/virtiofsd",
+	"/usr/lib/qemu/virtiofsd",
+	"/usr/bin/virtiofsd",
+	"/usr/lib/virtiofsd",
+}
+
+// domainCapabilities holds the part of the domain capabilities of the
+// hypervisor we need
+type domainCapabilities struct {
+	Loaders    []string `xml:"os>loader>value"`
+	Filesystem struct {
+		Supported string `xml:"supported,attr"`
+		Enums     []struct {
+			Name   string   `xml:"name,attr"`
+			Values []string `xml:"value"`
+		} `xml:"enum"`
+	} `xml:"devices>filesystem"`
+}
+
+// filesystemDrivers gives the drivers of shared filesystems listed in the
+// domain capabilities, ok is false when they are not listed
+func filesystemDrivers(desc string) ([]string, bool) {
+	caps := domainCapabilities{}
+	if err := xml.Unmarshal([]byte(desc), &caps); err != nil {
+		return nil, false
+	}
+
+	for _, e := range caps.Filesystem.Enums {
+		if e.Name == "driverType" {
+			return e.Values, true
+		}
+	}
+
+	return nil, false
+}
+
+// VirtiofsSupported tells if the hypervisor can share directories of the
+// host with virtiofs: libvirt must be 6.2 or later and list virtiofs in its
+// domain capabilities. Older versions do not list the drivers, virtiofsd is
+// searched then, which is only possible on a local hypervisor.
+func VirtiofsSupported(h Hypervisor) bool {
+	version, err := h.Conn.GetLibVersion()
+	if err != nil || version < 6002000 {
+		return false
+	}
+
+	if desc, err := h.Conn.GetDomainCapabilities("", "", "", "kvm", 0); err == nil {
+		if drivers, ok := filesystemDrivers(desc); ok {
+			for _, d := range drivers {
+				if d == "virtiofs" {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	if !h.IsLocal() {
+		return false
+	}
+
+	for _, p := range virtiofsdPaths {
+		if _, err := os.Stat(p); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
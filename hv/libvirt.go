@@ -10,6 +10,10 @@ import (
 	libvirt "libvirt.org/go/libvirt"
 	"log"
 	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
 type Hypervisor struct {
@@ -18,15 +22,17 @@ type Hypervisor struct {
 }
 
 type Domain struct {
-	Type     string  `xml:"type,attr"`
-	Name     string  `xml:"name"`
-	Uuid     string  `xml:"uuid"`
-	Memory   Memory  `xml:"memory"`
-	Vcpu     int     `xml:"vcpu"`
-	Emulator string  `xml:"device>emulator"`
-	Disks    []Disk  `xml:"devices>disk"`
-	Ifaces   []Iface `xml:"devices>interface"`
+	Type     string    `xml:"type,attr"`
+	Name     string    `xml:"name"`
+	Uuid     string    `xml:"uuid"`
+	Memory   Memory    `xml:"memory"`
+	Vcpu     int       `xml:"vcpu"`
+	Emulator string    `xml:"device>emulator"`
+	Disks    []Disk    `xml:"devices>disk"`
+	Ifaces   []Iface   `xml:"devices>interface"`
+	Channels []Channel `xml:"devices>channel"`
 	Status   bool
+	Guest    []string // addresses reported by the guest agent
 }
 
 type Memory struct {
@@ -34,11 +40,27 @@ type Memory struct {
 	Unit string `xml:"unit,attr"`
 }
 
+// Bytes gives the size of the memory in bytes, libvirt defaults to KiB
+func (m Memory) Bytes() int64 {
+	switch m.Unit {
+	case "b", "bytes":
+		return int64(m.Size)
+	case "M", "MiB":
+		return int64(m.Size) << 20
+	case "G", "GiB":
+		return int64(m.Size) << 30
+	default:
+		return int64(m.Size) << 10
+	}
+}
+
 type Disk struct {
-	Type   string `xml:"type,attr"`
-	Kind   string `xml:"device,attr"`
-	Device Target `xml:"target"`
-	Source Source `xml:"source"`
+	Type       string `xml:"type,attr"`
+	Kind       string `xml:"device,attr"`
+	Device     Target `xml:"target"`
+	Source     Source `xml:"source"`
+	Capacity   int64  // bytes, for volumes
+	Allocation int64  // bytes, for volumes
 }
 
 type Source struct {
@@ -62,17 +84,66 @@ type Iface struct {
 	Device Target     `xml:"target"`
 }
 
+// A Channel is a virtio channel between the host and the guest, e.g. the one
+// of the guest agent
+type Channel struct {
+	Target struct {
+		Type  string `xml:"type,attr"`
+		Name  string `xml:"name,attr"`
+		State string `xml:"state,attr"` // only in the live definition
+	} `xml:"target"`
+}
+
+// AgentConnected tells if the guest agent of a running domain is connected
+// to its channel. The agent may still not answer, during boot for example.
+func (dom Domain) AgentConnected() bool {
+	for _, c := range dom.Channels {
+		if c.Target.Name == "org.qemu.guest_agent.0" {
+			return c.Target.State == "connected"
+		}
+	}
+
+	return false
+}
+
 type MacAddress struct {
 	Address string `xml:"address,attr"`
 }
 
 type Network struct {
-	XMLName xml.Name   `xml:"network"`
-	Name    string     `xml:"name"`
-	Uuid    string     `xml:"uuid"`
-	Address NetIP      `xml:"ip"` // bridge address
-	Mac     MacAddress `xml:"mac"`
-	Hosts   []DnsHost  `xml:"dns>host"`
+	XMLName   xml.Name   `xml:"network"`
+	Name      string     `xml:"name"`
+	Uuid      string     `xml:"uuid"`
+	Address   NetIP      `xml:"-"` // bridge address
+	Address6  NetIP      `xml:"-"` // IPv6 bridge address of dual-stack networks
+	Addresses []NetIP    `xml:"ip"`
+	Mac       MacAddress `xml:"mac"`
+	Hosts     []DnsHost  `xml:"dns>host"`
+	TXTs      []DnsTXT   `xml:"dns>txt"`
+	Forward   NetForward `xml:"forward"`
+	Bridge    NetBridge  `xml:"bridge"`
+}
+
+// NetForward tells how the traffic of a network reaches the outside, it has
+// no mode when the network is isolated
+type NetForward struct {
+	Mode string `xml:"mode,attr"`
+}
+
+type NetBridge struct {
+	Name string `xml:"name,attr"`
+}
+
+// Mode gives the mode of the network: nat, route, isolated or bridge:<bridge>
+func (n Network) Mode() string {
+	switch n.Forward.Mode {
+	case "":
+		return "isolated"
+	case "bridge":
+		return fmt.Sprintf("bridge:%s", n.Bridge.Name)
+	}
+
+	return n.Forward.Mode
 }
 
 // func NewNetwork(name string, address string) Network {
@@ -113,8 +184,15 @@ type NetIP struct {
 func (i NetIP) String() string {
 	var mask net.IPMask
 
+	// bridged networks have no address
+	if i.Address == "" {
+		return ""
+	}
+
 	if i.Netmask != "" {
 		mask = net.IPMask(net.ParseIP(i.Netmask).To4())
+	} else if i.Family == "ipv6" || strings.Contains(i.Address, ":") {
+		mask = net.CIDRMask(i.Prefix, 128)
 	} else {
 		mask = net.CIDRMask(i.Prefix, 32)
 	}
@@ -127,29 +205,15 @@ func (i NetIP) String() string {
 	return n.String()
 }
 
+// A DnsHost is an address of the DNS of a network, with all its names: the
+// name of the VM and its aliases
 type DnsHost struct {
-	Address  string `xml:"ip,attr"`
-	Hostname string `xml:"hostname"`
+	Address   string   `xml:"ip,attr"`
+	Hostnames []string `xml:"hostname"`
 }
 
 func (dom Domain) String() string {
-	s := fmt.Sprintf("Domain: %s (%s) %s\n", dom.Name, dom.Type, dom.Uuid)
-	s += fmt.Sprintf("  cpu: %d, mem: %d %s\n", dom.Vcpu, dom.Memory.Size, dom.Memory.Unit)
-	s += "  disks:\n"
-	for _, disk := range dom.Disks {
-		switch disk.Type {
-		case "volume":
-			s += fmt.Sprintf("   - %s: %s/%s - volume: %s::%s\n", disk.Kind, disk.Device.Bus, disk.Device.Dev, disk.Source.Pool, disk.Source.Volume)
-		case "file":
-			s += fmt.Sprintf("   - %s: %s/%s - path: %s\n", disk.Kind, disk.Device.Bus, disk.Device.Dev, disk.Source.File)
-		}
-	}
-	s += "  interfaces:\n"
-	for _, iface := range dom.Ifaces {
-		s += fmt.Sprintf("   - %s %s net: %s bridge: %s\n", iface.Device.Dev, iface.Mac.Address, iface.Source.Network, iface.Source.Bridge)
-	}
-
-	return s
+	return newDomainDetails(dom).String()
 }
 
 func (n Network) String() string {
@@ -157,19 +221,30 @@ func (n Network) String() string {
 	s += fmt.Sprintf("  address: %s\n", n.Address)
 	s += "  hosts:\n"
 	for _, h := range n.Hosts {
-		s += fmt.Sprintf("    %s  %s\n", h.Address, h.Hostname)
+		s += fmt.Sprintf("    %s  %s\n", h.Address, strings.Join(h.Hostnames, " "))
 	}
 	return s
 }
 
 func (n Network) LookupDnsHostByName(name string) net.IP {
+	// dual-stack networks also have an IPv6 entry per host, the IPv4
+	// address is preferred
+	found := net.IP{}
 	for _, entry := range n.Hosts {
-		if entry.Hostname == name {
-			return net.ParseIP(entry.Address)
+		for _, hostname := range entry.Hostnames {
+			if hostname != name {
+				continue
+			}
+
+			ip := net.ParseIP(entry.Address)
+			if ip.To4() != nil {
+				return ip
+			}
+			found = ip
 		}
 	}
 
-	return net.IP{}
+	return found
 }
 
 func NewHypervisor(uri string) (Hypervisor, error) {
@@ -185,6 +260,40 @@ func NewHypervisor(uri string) (Hypervisor, error) {
 	return h, nil
 }
 
+// IsLocal tells if the hypervisor runs on the local host, from its URI: a
+// remote URI has a hostname
+func (h Hypervisor) IsLocal() bool {
+	u, err := url.Parse(h.Uri)
+	if err != nil {
+		return false
+	}
+
+	return u.Host == ""
+}
+
+// NvramDir gives the directory where libvirt keeps the NVRAM files of the
+// domains, it depends on the driver of the URI. The directory of a session of
+// another user on a remote host cannot be known.
+func (h Hypervisor) NvramDir() (string, error) {
+	u, err := url.Parse(h.Uri)
+	if err != nil {
+		return "", fmt.Errorf("invalid URI %s: %w", h.Uri, err)
+	}
+
+	switch {
+	case u.Path == "/system":
+		return "/var/lib/libvirt/qemu/nvram", nil
+	case u.Path == "/session" && h.IsLocal():
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return "", fmt.Errorf("could not find the NVRAM directory of the session: %w", err)
+		}
+		return filepath.Join(dir, "libvirt/qemu/nvram"), nil
+	}
+
+	return "", fmt.Errorf("could not find where the hypervisor %s keeps the NVRAM files", h.Uri)
+}
+
 func (h Hypervisor) Close() (int, error) {
 	return h.Conn.Close()
 }
@@ -204,6 +313,15 @@ func parseNetworkXMLDesc(desc string) (Network, error) {
 	if err != nil {
 		return v, fmt.Errorf("parseNetworkXMLDesc: %w", err)
 	}
+
+	for _, a := range v.Addresses {
+		if a.Family == "ipv6" {
+			v.Address6 = a
+		} else {
+			v.Address = a
+		}
+	}
+
 	return v, nil
 }
 
@@ -277,25 +395,7 @@ func ListDomains(h Hypervisor) ([]Domain, error) {
 			continue
 		}
 
-		for i, disk := range domain.Disks {
-			if disk.Source.Pool != "" && disk.Source.Volume != "" {
-				volume, err := LookupVolume(h, disk.Source.Pool, disk.Source.Volume)
-				if err != nil {
-					log.Printf("could not get information on volume %s (%s): %s", disk.Source.Volume, disk.Source.Pool, err)
-					continue
-				}
-
-				// find the name of the volume of the backing store
-				if volume.BackingStore != "" {
-					backVolume, err := LookupVolumeByPath(h, volume.BackingStore)
-					if err != nil {
-						log.Printf("could not get volume info for backing store %s: %s", volume.BackingStore, err)
-					} else {
-						domain.Disks[i].Source.BackingVolName = backVolume.Name
-					}
-				}
-			}
-		}
+		fillDiskVolumes(h, &domain)
 
 		active, err := dom.IsActive()
 		if err != nil {
@@ -304,12 +404,47 @@ func ListDomains(h Hypervisor) ([]Domain, error) {
 		}
 
 		domain.Status = active
+
+		// the guest agent may not run in the domain, we only miss the
+		// addresses it reports then. Calling an agent that is not
+		// connected blocks until the timeout.
+		if active && domain.AgentConnected() {
+			domain.Guest, _ = guestAddresses(&dom)
+		}
+
 		domains = append(domains, domain)
 	}
 
 	return domains, nil
 }
 
+// fillDiskVolumes completes the disks of the domain with the information on
+// their volume
+func fillDiskVolumes(h Hypervisor, domain *Domain) {
+	for i, disk := range domain.Disks {
+		if disk.Source.Pool != "" && disk.Source.Volume != "" {
+			volume, err := LookupVolume(h, disk.Source.Pool, disk.Source.Volume)
+			if err != nil {
+				log.Printf("could not get information on volume %s (%s): %s", disk.Source.Volume, disk.Source.Pool, err)
+				continue
+			}
+
+			domain.Disks[i].Capacity = volume.Capacity
+			domain.Disks[i].Allocation = volume.Allocation
+
+			// find the name of the volume of the backing store
+			if volume.BackingStore != "" {
+				backVolume, err := LookupVolumeByPath(h, volume.BackingStore)
+				if err != nil {
+					log.Printf("could not get volume info for backing store %s: %s", volume.BackingStore, err)
+				} else {
+					domain.Disks[i].Source.BackingVolName = backVolume.Name
+				}
+			}
+		}
+	}
+}
+
 func ListDomainsByNetwork(h Hypervisor, network Network) ([]Domain, error) {
 	allDomains, err := ListDomains(h)
 	if err != nil {
@@ -0,0 +1,89 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hv
+
+import (
+	"fmt"
+	"time"
+
+	libvirt "libvirt.org/go/libvirt"
+)
+
+// DomainStats holds the cumulative counters of a running domain at a given
+// time
+type DomainStats struct {
+	Name       string
+	Time       time.Time
+	Vcpus      int
+	CpuTime    uint64 // ns
+	Memory     int64  // bytes
+	MemUsed    int64  // bytes
+	ReadBytes  uint64
+	WriteBytes uint64
+	RxBytes    uint64
+	TxBytes    uint64
+}
+
+// GetDomainStats collects the statistics of all the running domains in one
+// call
+func GetDomainStats(h Hypervisor) ([]DomainStats, error) {
+	types := libvirt.DOMAIN_STATS_CPU_TOTAL | libvirt.DOMAIN_STATS_BALLOON | libvirt.DOMAIN_STATS_VCPU |
+		libvirt.DOMAIN_STATS_INTERFACE | libvirt.DOMAIN_STATS_BLOCK
+
+	all, err := h.Conn.GetAllDomainStats(nil, types, libvirt.CONNECT_GET_ALL_DOMAINS_STATS_RUNNING)
+	if err != nil {
+		return nil, fmt.Errorf("could not get domain statistics: %w", err)
+	}
+
+	now := time.Now()
+	stats := make([]DomainStats, 0, len(all))
+	for _, s := range all {
+		name, err := s.Domain.GetName()
+		s.Domain.Free()
+		if err != nil {
+			continue
+		}
+
+		ds := DomainStats{
+			Name:  name,
+			Time:  now,
+			Vcpus: len(s.Vcpu),
+		}
+
+		if s.Cpu != nil && s.Cpu.TimeSet {
+			ds.CpuTime = s.Cpu.Time
+		}
+
+		if b := s.Balloon; b != nil {
+			if b.CurrentSet {
+				ds.Memory = int64(b.Current) * 1024
+			}
+
+			// the unused memory is only known when the guest reports it
+			// with the balloon driver, use the resident size of qemu
+			// otherwise
+			switch {
+			case b.UnusedSet && b.CurrentSet:
+				ds.MemUsed = int64(b.Current-b.Unused) * 1024
+			case b.RssSet:
+				ds.MemUsed = int64(b.Rss) * 1024
+			}
+		}
+
+		for _, blk := range s.Block {
+			ds.ReadBytes += blk.RdBytes
+			ds.WriteBytes += blk.WrBytes
+		}
+
+		for _, n := range s.Net {
+			ds.RxBytes += n.RxBytes
+			ds.TxBytes += n.TxBytes
+		}
+
+		stats = append(stats, ds)
+	}
+
+	return stats, nil
+}
@@ -16,14 +16,17 @@ import (
 )
 
 type Pool struct {
-	XMLName xml.Name `xml:"pool"`
-	Name    string   `xml:"name"`
-	Type    string   `xml:"type,attr"`
-	Uuid    string   `xml:"uuid"`
-	Path    string   `xml:"target>path"`
-	Mode    int      `xml:"target>permissions>mode"`
-	Uid     int      `xml:"target>permissions>owner"`
-	Gid     int      `xml:"target>permissions>group"`
+	XMLName    xml.Name `xml:"pool"`
+	Name       string   `xml:"name"`
+	Type       string   `xml:"type,attr"`
+	Uuid       string   `xml:"uuid"`
+	Capacity   int64    `xml:"capacity"`   // bytes
+	Allocation int64    `xml:"allocation"` // bytes
+	Available  int64    `xml:"available"`  // bytes
+	Path       string   `xml:"target>path"`
+	Mode       int      `xml:"target>permissions>mode"`
+	Uid        int      `xml:"target>permissions>owner"`
+	Gid        int      `xml:"target>permissions>group"`
 }
 
 type Volume struct {
@@ -32,6 +35,7 @@ type Volume struct {
 	Type         string    `xml:"type,attr"`
 	Key          string    `xml:"key"`
 	Capacity     int64     `xml:"capacity"`
+	Allocation   int64     `xml:"allocation"`
 	Size         int64     `xml:"physical"`
 	Path         string    `xml:"target>path"`
 	Format       VolFormat `xml:"target>format"`
@@ -245,6 +249,29 @@ func RemoveVolume(h Hypervisor, poolName string, volName string) error {
 	return nil
 }
 
+// ResizeVolume changes the capacity of a volume in the pool on the hypervisor,
+// it can only grow
+func ResizeVolume(h Hypervisor, poolName string, volName string, capacity int64) error {
+	sp, err := h.Conn.LookupStoragePoolByName(poolName)
+	if err != nil {
+		return fmt.Errorf("could not lookup storage pool %s: %w", poolName, err)
+	}
+	defer sp.Free()
+
+	sv, err := sp.LookupStorageVolByName(volName)
+	if err != nil {
+		return fmt.Errorf("could not lookup volume %s in pool %s: %w", volName, poolName, err)
+	}
+	defer sv.Free()
+
+	err = sv.Resize(uint64(capacity), 0)
+	if err != nil {
+		return fmt.Errorf("could not resize volume %s: %w", volName, err)
+	}
+
+	return nil
+}
+
 // UploadVolume writes contents from the input io.Reader to an existing volume
 // using the hypervisor API. The capacity of the volume must be big enough to
 // store all the input data.
@@ -316,18 +343,16 @@ func UploadVolume(h Hypervisor, poolName string, volName string, r io.Reader) er
 	return nil
 }
 
-func sizePretty(s int) string {
-	unit := "B"
+// SizePretty formats a size in bytes with a human readable unit
+func SizePretty(s int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
 	size := float64(s)
-	if math.Abs(size) > 1024 {
+	u := 0
+	for math.Abs(size) > 1024 && u < len(units)-1 {
 		size /= 1024
-		unit = "kB"
-		if math.Abs(size) > 1024 {
-			size /= 1024
-			unit = "MB"
-		}
+		u++
 	}
-	return fmt.Sprintf("%.2f %s", size, unit)
+	return fmt.Sprintf("%.2f %s", size, units[u])
 }
 
 // VolumeExists checks if a volume exists in the pool on the hypervisor
@@ -361,3 +386,44 @@ func parseVolumeXMLDesc(desc string) (Volume, error) {
 	}
 	return v, nil
 }
+
+// CloneVolume creates a new volume in the pool with a copy of the contents
+// of an existing volume of the same pool, it returns the new volume
+func CloneVolume(h Hypervisor, poolName string, srcName string, dstName string) (Volume, error) {
+	sp, err := h.Conn.LookupStoragePoolByName(poolName)
+	if err != nil {
+		return Volume{}, fmt.Errorf("could not lookup storage pool %s: %w", poolName, err)
+	}
+	defer sp.Free()
+
+	src, err := sp.LookupStorageVolByName(srcName)
+	if err != nil {
+		return Volume{}, fmt.Errorf("could not lookup volume %s: %w", srcName, err)
+	}
+	defer src.Free()
+
+	// the capacity is taken from the source volume
+	volDef := Volume{
+		Name:   dstName,
+		Type:   "file",
+		Format: VolFormat{Type: "qcow2"},
+	}
+
+	xml, err := xml.Marshal(volDef)
+	if err != nil {
+		return Volume{}, fmt.Errorf("could not create XML volume definition: %w", err)
+	}
+
+	sv, err := sp.StorageVolCreateXMLFrom(string(xml), src, 0)
+	if err != nil {
+		return Volume{}, fmt.Errorf("could not clone volume %s: %w", srcName, err)
+	}
+	defer sv.Free()
+
+	desc, err := sv.GetXMLDesc(0)
+	if err != nil {
+		return Volume{}, fmt.Errorf("could not get XML description of volume %s: %w", dstName, err)
+	}
+
+	return parseVolumeXMLDesc(desc)
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"fmt"
+
+	"github.com/orgrim/carcass/hv"
+)
+
+// Resources is an amount of vCPU, memory and disk space required by new or
+// resized machines
+type Resources struct {
+	Vcpus  int
+	Memory int64            // bytes
+	Disks  map[string]int64 // storage pool -> bytes
+}
+
+// A CapacityCheck compares a needed resource with what is available on the
+// host
+type CapacityCheck struct {
+	Resource  string
+	Need      int64
+	Available int64
+	Bytes     bool
+}
+
+// Ok tells if the resource is available
+func (c CapacityCheck) Ok() bool {
+	return c.Need <= c.Available
+}
+
+func (c CapacityCheck) String() string {
+	status := "ok"
+	if !c.Ok() {
+		status = "insufficient"
+	}
+
+	if c.Bytes {
+		return fmt.Sprintf("%s: need %s, available %s: %s", c.Resource, hv.SizePretty(c.Need), hv.SizePretty(c.Available), status)
+	}
+
+	return fmt.Sprintf("%s: need %d, available %d: %s", c.Resource, c.Need, c.Available, status)
+}
+
+// A CapacityReport is the result of the checks of all resources
+type CapacityReport []CapacityCheck
+
+// Ok tells if all resources are available
+func (r CapacityReport) Ok() bool {
+	for _, c := range r {
+		if !c.Ok() {
+			return false
+		}
+	}
+	return true
+}
+
+func (r CapacityReport) String() string {
+	s := ""
+	for _, c := range r {
+		s += fmt.Sprintf("  %s\n", c)
+	}
+	return s
+}
+
+// CheckCapacity compares the needed resources with the free memory and CPU
+// count of the host and the available space in the storage pools
+func CheckCapacity(h *hv.Hypervisor, need Resources) (CapacityReport, error) {
+	host, err := hv.LookupHostInfo(*h)
+	if err != nil {
+		return nil, fmt.Errorf("could not check capacity: %w", err)
+	}
+
+	pools := make([]hv.Pool, 0, len(need.Disks))
+	for name := range need.Disks {
+		pool, err := hv.LookupPool(*h, name)
+		if err != nil {
+			return nil, fmt.Errorf("could not check capacity: %w", err)
+		}
+		pools = append(pools, pool)
+	}
+
+	return checkResources(host, pools, need), nil
+}
+
+func checkResources(host hv.HostInfo, pools []hv.Pool, need Resources) CapacityReport {
+	report := CapacityReport{
+		{Resource: "vcpu", Need: int64(need.Vcpus), Available: int64(host.Cpus)},
+		{Resource: "memory", Need: need.Memory, Available: host.FreeMemory, Bytes: true},
+	}
+
+	for _, pool := range pools {
+		report = append(report, CapacityCheck{
+			Resource:  fmt.Sprintf("storage pool %s", pool.Name),
+			Need:      need.Disks[pool.Name],
+			Available: pool.Available,
+			Bytes:     true,
+		})
+	}
+
+	return report
+}
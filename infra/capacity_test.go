@@ -0,0 +1,41 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/orgrim/carcass/hv"
+)
+
+func TestCheckResources(t *testing.T) {
+	host := hv.HostInfo{Cpus: 4, Memory: 16 << 30, FreeMemory: 4 << 30}
+	pools := []hv.Pool{
+		{Name: "default", Available: 20 << 30},
+		{Name: "ssd", Available: 10 << 30},
+	}
+
+	var tests = []struct {
+		input Resources
+		want  bool
+	}{
+		{Resources{2, 2 << 30, map[string]int64{"default": 8 << 30}}, true},
+		{Resources{4, 4 << 30, map[string]int64{"default": 20 << 30, "ssd": 10 << 30}}, true},
+		{Resources{8, 2 << 30, map[string]int64{"default": 8 << 30}}, false},
+		{Resources{2, 8 << 30, map[string]int64{"default": 8 << 30}}, false},
+		{Resources{2, 2 << 30, map[string]int64{"default": 100 << 30}}, false},
+		{Resources{2, 2 << 30, map[string]int64{"default": 8 << 30, "ssd": 20 << 30}}, false},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got := checkResources(host, pools, st.input).Ok()
+			if got != st.want {
+				t.Errorf("got: %v, want %v", got, st.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// A Forward relays the TCP connections received on an address of the host
+// to a port of a machine
+type Forward struct {
+	Env    string `json:"env"`
+	Vm     string `json:"vm"`
+	Listen string `json:"listen"` // host:port
+	Target string `json:"target"` // ip:port of the machine
+	Pid    int    `json:"pid"`    // process running the proxy
+}
+
+func (f Forward) String() string {
+	return fmt.Sprintf("%s -> %s (%s/%s)", f.Listen, f.Target, f.Env, f.Vm)
+}
+
+// ServeListener relays the connections accepted by l to the target until the
+// context is cancelled, l is closed then. Temporary errors of Accept, like
+// running out of file descriptors, are retried after a delay, others stop
+// the forward.
+func (f Forward) ServeListener(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	var (
+		wg    sync.WaitGroup
+		delay time.Duration
+		err   error
+	)
+
+	for {
+		var conn net.Conn
+		conn, err = l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				err = nil
+				break
+			}
+
+			// back off like net/http does, the delay doubles up to
+			// one second
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+
+				log.Printf("could not accept connection: %s, retrying in %s", err, delay)
+				select {
+				case <-ctx.Done():
+				case <-time.After(delay):
+				}
+				continue
+			}
+
+			err = fmt.Errorf("could not accept connection: %w", err)
+			break
+		}
+		delay = 0
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.relay(ctx, conn)
+		}()
+	}
+
+	wg.Wait()
+	return err
+}
+
+func (f Forward) relay(ctx context.Context, client net.Conn) {
+	defer client.Close()
+
+	d := net.Dialer{Timeout: 10 * time.Second}
+	server, err := d.DialContext(ctx, "tcp", f.Target)
+	if err != nil {
+		log.Printf("could not connect to %s for %s: %s", f.Target, client.RemoteAddr(), err)
+		return
+	}
+	defer server.Close()
+
+	// closing both ends when the context is done unblocks the copies
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+			server.Close()
+		case <-done:
+		}
+	}()
+
+	// when one side has finished sending, the other one is told so and
+	// may still answer, a client can half-close after its request
+	var wg sync.WaitGroup
+	pipe := func(dst net.Conn, src net.Conn) {
+		defer wg.Done()
+		if _, err := io.Copy(dst, src); err != nil {
+			client.Close()
+			server.Close()
+			return
+		}
+		closeWrite(dst)
+	}
+
+	wg.Add(2)
+	go pipe(server, client)
+	go pipe(client, server)
+	wg.Wait()
+}
+
+// closeWrite shuts down the writing side of a TCP connection, other kinds of
+// connections are closed
+func closeWrite(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.CloseWrite()
+		return
+	}
+	c.Close()
+}
+
+// ReadForward loads the state of a forward from a file
+func ReadForward(path string) (Forward, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Forward{}, fmt.Errorf("could not read forward state file: %w", err)
+	}
+
+	var f Forward
+	if err := json.Unmarshal(data, &f); err != nil {
+		return Forward{}, fmt.Errorf("could not decode forward state file: %w", err)
+	}
+
+	return f, nil
+}
+
+// Save writes the state of the forward to a file
+func (f Forward) Save(path string) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode forward state to json: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("could not create forward state file: %w", err)
+	}
+
+	return nil
+}
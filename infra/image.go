@@ -28,6 +28,7 @@ type Image struct {
 	Format   string // format of the image qcow2 of other
 	Capacity int64
 	Size     int64
+	Firmware string // "bios", "uefi" or "uefi-secure", bios when empty
 }
 
 // NewImage initializes a Image struct with the given name and associated
@@ -154,13 +155,44 @@ func (i *Image) Exists(h *hv.Hypervisor) (bool, error) {
 // AddSourceMap registers the source of the image into the source map file
 // located in the given directory
 func (i *Image) AddSourceMap(dir string) error {
-	path := sourceMapPath(dir)
+	return addToMap(sourceMapPath(dir), i.Pool, i.Name, i.Source)
+}
 
+// RemoveSourceMap deregisters the source of the image from the source map file
+// located in the given directory
+func (i *Image) RemoveSourceMap(dir string) error {
+	return removeFromMap(sourceMapPath(dir), i.Pool, i.Name)
+}
+
+// AddFirmwareMap registers the firmware needed by the image into the
+// firmware map file located in the given directory
+func (i *Image) AddFirmwareMap(dir string) error {
+	return addToMap(firmwareMapPath(dir), i.Pool, i.Name, i.Firmware)
+}
+
+// RemoveFirmwareMap deregisters the firmware of the image from the firmware
+// map file located in the given directory
+func (i *Image) RemoveFirmwareMap(dir string) error {
+	return removeFromMap(firmwareMapPath(dir), i.Pool, i.Name)
+}
+
+// LookupImageFirmware gives the firmware registered for the image in the
+// firmware map file located in the given directory, it is empty when unknown
+func LookupImageFirmware(dir string, pool string, name string) string {
+	m, err := readSourceMap(firmwareMapPath(dir))
+	if err != nil || m == nil {
+		return ""
+	}
+
+	return m[pool][name]
+}
+
+func addToMap(path string, pool string, name string, value string) error {
 	m, err := readSourceMap(path)
 	if err != nil {
 		perr := errors.Unwrap(err)
 		if !errors.Is(perr, os.ErrNotExist) {
-			return fmt.Errorf("could not read source map file: %w", err)
+			return fmt.Errorf("could not read map file: %w", err)
 		}
 	}
 
@@ -168,30 +200,26 @@ func (i *Image) AddSourceMap(dir string) error {
 		m = make(SourceMap)
 	}
 
-	if _, ok := m[i.Pool]; !ok {
-		m[i.Pool] = make(SourceMapEntry)
+	if _, ok := m[pool]; !ok {
+		m[pool] = make(SourceMapEntry)
 	}
 
-	m[i.Pool][i.Name] = i.Source
+	m[pool][name] = value
 
 	err = writeSourceMap(m, path)
 	if err != nil {
-		return fmt.Errorf("could not save source map file: %w", err)
+		return fmt.Errorf("could not save map file: %w", err)
 	}
 
 	return nil
 }
 
-// RemoveSourceMap deregisters the source of the image from the source map file
-// located in the given directory
-func (i *Image) RemoveSourceMap(dir string) error {
-	path := sourceMapPath(dir)
-
+func removeFromMap(path string, pool string, name string) error {
 	m, err := readSourceMap(path)
 	if err != nil {
 		perr := errors.Unwrap(err)
 		if !errors.Is(perr, os.ErrNotExist) {
-			return fmt.Errorf("could not read source map file: %w", err)
+			return fmt.Errorf("could not read map file: %w", err)
 		}
 	}
 
@@ -199,15 +227,15 @@ func (i *Image) RemoveSourceMap(dir string) error {
 		return nil
 	}
 
-	if _, ok := m[i.Pool]; !ok {
+	if _, ok := m[pool]; !ok {
 		return nil
 	}
 
-	delete(m[i.Pool], i.Name)
+	delete(m[pool], name)
 
 	err = writeSourceMap(m, path)
 	if err != nil {
-		return fmt.Errorf("could not save source map file: %w", err)
+		return fmt.Errorf("could not save map file: %w", err)
 	}
 
 	return nil
@@ -225,8 +253,13 @@ func (i *Image) volumeName() string {
 
 // String returns the information on a image in a YAML like format
 func (i *Image) String() string {
-	return fmt.Sprintf("%s:\n  pool: %s\n  source: %s\n  path: %s\n  format: %s\n  space: %d/%d",
-		i.Name, i.Pool, i.Source, i.Path, i.Format, i.Size, i.Capacity)
+	firmware := i.Firmware
+	if firmware == "" {
+		firmware = "bios"
+	}
+
+	return fmt.Sprintf("%s:\n  pool: %s\n  source: %s\n  path: %s\n  format: %s\n  firmware: %s\n  space: %d/%d",
+		i.Name, i.Pool, i.Source, i.Path, i.Format, firmware, i.Size, i.Capacity)
 }
 
 // ImageNameFromVolume compute the name of the image for the volume name of the hypervisor
@@ -244,12 +277,14 @@ func LookupImages(h *hv.Hypervisor, poolName string, sourceMapDir string) ([]*Im
 	}
 
 	var (
-		m       SourceMap
-		sources SourceMapEntry
+		m, fm     SourceMap
+		sources   SourceMapEntry
+		firmwares SourceMapEntry
 	)
 
 	if sourceMapDir != "" {
 		m, _ = readSourceMap(sourceMapPath(sourceMapDir))
+		fm, _ = readSourceMap(firmwareMapPath(sourceMapDir))
 	}
 
 	sources = make(SourceMapEntry)
@@ -259,6 +294,13 @@ func LookupImages(h *hv.Hypervisor, poolName string, sourceMapDir string) ([]*Im
 		}
 	}
 
+	firmwares = make(SourceMapEntry)
+	if fm != nil {
+		if f, ok := fm[poolName]; ok {
+			firmwares = f
+		}
+	}
+
 	images := make([]*Image, 0)
 	for _, vol := range vols {
 		if strings.HasSuffix(vol.Name, "-base.qcow2") {
@@ -272,6 +314,7 @@ func LookupImages(h *hv.Hypervisor, poolName string, sourceMapDir string) ([]*Im
 				Capacity: vol.Capacity,
 				Size:     vol.Size,
 				Source:   sources[distrib],
+				Firmware: firmwares[distrib],
 			}
 			images = append(images, &i)
 		}
@@ -287,6 +330,10 @@ func sourceMapPath(dir string) string {
 	return filepath.Clean(filepath.Join(dir, "image-sources.json"))
 }
 
+func firmwareMapPath(dir string) string {
+	return filepath.Clean(filepath.Join(dir, "image-firmwares.json"))
+}
+
 func readSourceMap(path string) (SourceMap, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -7,6 +7,10 @@ package infra
 import (
 	"fmt"
 	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/orgrim/carcass/hv"
 	"github.com/orgrim/carcass/terraform"
@@ -59,9 +63,66 @@ func LookupByName(h *hv.Hypervisor, netName string) (*Infrastructure, error) {
 //
 // A valid Config is required for other operations.
 func (i *Infrastructure) LoadConfig(path string) error {
+	conf, err := terraform.ParseModuleConfig(path)
+	if err != nil {
+		return fmt.Errorf("could not load configuration: %w", err)
+	}
+
+	i.Config = conf
+	return nil
+}
+
+// ShortName gives the name of the machine in the configuration from the name
+// of the domain on the hypervisor, e.g. "pg1" for "pg1.mylab"
+func (i *Infrastructure) ShortName(domName string) string {
+	if i.Config.Module.Domain == "" {
+		return domName
+	}
+
+	return strings.TrimSuffix(domName, "."+i.Config.Module.Domain)
+}
+
+// MachineAddress finds the IP address of a domain, using the DNS entries of
+// the network first and the configuration as a fallback
+func (i *Infrastructure) MachineAddress(domName string) net.IP {
+	ip := i.Network.LookupDnsHostByName(domName)
+	if len(ip) > 0 {
+		return ip
+	}
+
+	if m, ok := i.Config.Module.Machines[i.ShortName(domName)]; ok {
+		return net.ParseIP(m.IPAddress)
+	}
+
 	return nil
 }
 
+// BootGroups sorts the machines by boot group, according to the
+// configuration. Machines not found in the configuration go in group 0.
+func (i *Infrastructure) BootGroups() [][]hv.Domain {
+	groups := make(map[int][]hv.Domain)
+	for _, m := range i.Machines {
+		g := 0
+		if c, ok := i.Config.Module.Machines[i.ShortName(m.Name)]; ok {
+			g = c.BootGroup
+		}
+		groups[g] = append(groups[g], m)
+	}
+
+	keys := make([]int, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+
+	stages := make([][]hv.Domain, 0, len(keys))
+	for _, k := range keys {
+		stages = append(stages, groups[k])
+	}
+
+	return stages
+}
+
 // RefreshRessources searches and loads current network and machines from the hypervisor
 //
 // It uses the configuration
@@ -71,48 +132,131 @@ func (i *Infrastructure) RefreshRessources() error {
 
 // Control
 func (i *Infrastructure) Start(name string) error {
-	for _, m := range i.Machines {
+	return i.control(name, "start")
+}
 
+// Reboot requests a reboot of the machine to the guest
+func (i *Infrastructure) Reboot(name string) error {
+	return i.control(name, "reboot")
+}
+
+// Reset forcefully resets the machine, like the reset button
+func (i *Infrastructure) Reset(name string) error {
+	return i.control(name, "reset")
+}
+
+// Pause suspends the execution of the machine
+func (i *Infrastructure) Pause(name string) error {
+	return i.control(name, "pause")
+}
+
+// Resume restarts the execution of a paused machine
+func (i *Infrastructure) Resume(name string) error {
+	return i.control(name, "resume")
+}
+
+// Destroy forcefully stops the machine, like pulling the plug
+func (i *Infrastructure) Destroy(name string) error {
+	return i.control(name, "destroy")
+}
+
+func (i *Infrastructure) control(name string, action string) error {
+	for _, m := range i.Machines {
 		if m.Name != name {
 			continue
 		}
 
-		dom, err := i.HV.Conn.LookupDomainByName(m.Name)
-		if err != nil {
-			log.Printf("could not lookup domain %s: %s", m.Name, err)
-			continue
+		log.Printf("request %s of: %s", action, m.Name)
+		return hv.ControlDomain(*i.HV, m.Name, action)
+	}
+
+	return fmt.Errorf("machine %s not found", name)
+}
+
+// StartAll starts the machines stage by stage, following their boot group. The
+// machines of a stage must be reachable with SSH before the next stage is
+// started, waiting at most timeout for each stage. It returns an error when
+// any machine failed to start.
+func (i *Infrastructure) StartAll(timeout time.Duration) error {
+	failed := make([]string, 0)
+
+	stages := i.BootGroups()
+	for n, stage := range stages {
+		started := make([]hv.Domain, 0, len(stage))
+
+		for _, m := range stage {
+			dom, err := i.HV.Conn.LookupDomainByName(m.Name)
+			if err != nil {
+				log.Printf("could not lookup domain %s: %s", m.Name, err)
+				failed = append(failed, m.Name)
+				continue
+			}
+			defer dom.Free()
+
+			active, err := dom.IsActive()
+			if err != nil {
+				log.Printf("could not get status of domain: %s", err)
+				failed = append(failed, m.Name)
+				continue
+			}
+
+			if !active {
+				log.Printf("request start of: %s", m.Name)
+				err = dom.Create()
+				if err != nil {
+					log.Printf("could not start domain %s: %s", m.Name, err)
+					failed = append(failed, m.Name)
+					continue
+				}
+			}
+
+			started = append(started, m)
 		}
-		defer dom.Free()
 
-		log.Printf("request start of: %s", m.Name)
-		err = dom.Create()
-		if err != nil {
-			log.Printf("could not start domain %s: %s", m.Name, err)
-			continue
+		// there is no need to wait for the last stage
+		if n == len(stages)-1 {
+			break
+		}
+
+		deadline := time.Now().Add(timeout)
+		for _, m := range started {
+			ip := i.MachineAddress(m.Name)
+			if ip == nil {
+				log.Printf("could not find the IP address of %s, not waiting", m.Name)
+				continue
+			}
+
+			log.Printf("waiting for %s (%s) to be reachable", m.Name, ip)
+			if err := waitReachable(net.JoinHostPort(ip.String(), "22"), deadline); err != nil {
+				log.Printf("domain %s is not reachable: %s", m.Name, err)
+				failed = append(failed, m.Name)
+			}
 		}
 	}
 
+	if len(failed) > 0 {
+		return fmt.Errorf("could not start: %s", strings.Join(failed, ", "))
+	}
+
 	return nil
 }
 
-func (i *Infrastructure) StartAll() error {
-	for _, m := range i.Machines {
-		dom, err := i.HV.Conn.LookupDomainByName(m.Name)
-		if err != nil {
-			log.Printf("could not lookup domain %s: %s", m.Name, err)
-			continue
+// waitReachable tries to open a TCP connection to addr until it succeeds or
+// the deadline is reached
+func waitReachable(addr string, deadline time.Time) error {
+	for {
+		conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
 		}
-		defer dom.Free()
 
-		log.Printf("request start of: %s", m.Name)
-		err = dom.Create()
-		if err != nil {
-			log.Printf("could not start domain %s: %s", m.Name, err)
-			continue
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout: %w", err)
 		}
-	}
 
-	return nil
+		time.Sleep(2 * time.Second)
+	}
 }
 
 func (i *Infrastructure) Stop(name string, force bool) error {
@@ -173,3 +317,60 @@ func (i *Infrastructure) StopAll(force bool) error {
 	}
 	return nil
 }
+
+// ShutdownWait requests a graceful shutdown of a machine and waits at most
+// timeout for it to stop. When destroy is true, the machine is forcefully
+// stopped if it is still running after the timeout.
+func (i *Infrastructure) ShutdownWait(name string, timeout time.Duration, destroy bool) error {
+	_, err := i.shutdownWait(name, timeout, destroy)
+	return err
+}
+
+// shutdownWait does the work of ShutdownWait, it tells if the machine had
+// to be forcefully stopped
+func (i *Infrastructure) shutdownWait(name string, timeout time.Duration, destroy bool) (bool, error) {
+	dom, err := i.HV.Conn.LookupDomainByName(name)
+	if err != nil {
+		return false, fmt.Errorf("could not lookup domain %s: %w", name, err)
+	}
+	defer dom.Free()
+
+	active, err := dom.IsActive()
+	if err != nil {
+		return false, fmt.Errorf("could not get status of domain: %w", err)
+	}
+
+	if !active {
+		return false, nil
+	}
+
+	log.Printf("request shutdown of: %s", name)
+	if err := dom.Shutdown(); err != nil {
+		return false, fmt.Errorf("could not shutdown domain %s: %w", name, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+
+		active, err = dom.IsActive()
+		if err != nil {
+			return false, fmt.Errorf("could not get status of domain: %w", err)
+		}
+
+		if !active {
+			return false, nil
+		}
+	}
+
+	if !destroy {
+		return false, fmt.Errorf("timeout waiting for %s to stop", name)
+	}
+
+	log.Printf("forcing stop of: %s", name)
+	if err := dom.Destroy(); err != nil {
+		return false, fmt.Errorf("could not destroy domain %s: %w", name, err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/orgrim/carcass/hv"
+	"github.com/orgrim/carcass/terraform"
+)
+
+func TestBootGroups(t *testing.T) {
+	i := Infrastructure{
+		Machines: []hv.Domain{
+			{Name: "pg1.lab"},
+			{Name: "etcd1.lab"},
+			{Name: "pg2.lab"},
+			{Name: "other.lab"},
+			{Name: "etcd2.lab"},
+		},
+	}
+	i.Config.Module.Domain = "lab"
+	i.Config.Module.Machines = map[string]terraform.Machine{
+		"etcd1": {BootGroup: -1},
+		"etcd2": {BootGroup: -1},
+		"pg1":   {BootGroup: 1},
+		"pg2":   {BootGroup: 1},
+	}
+
+	want := [][]string{
+		{"etcd1.lab", "etcd2.lab"},
+		{"other.lab"},
+		{"pg1.lab", "pg2.lab"},
+	}
+
+	got := i.BootGroups()
+	if len(got) != len(want) {
+		t.Fatalf("got %d groups, want %d", len(got), len(want))
+	}
+
+	for n, stage := range want {
+		t.Run(fmt.Sprintf("%v", n), func(t *testing.T) {
+			if len(got[n]) != len(stage) {
+				t.Fatalf("got %d machines, want %d", len(got[n]), len(stage))
+			}
+			for j, name := range stage {
+				if got[n][j].Name != name {
+					t.Errorf("got: %v, want %v", got[n][j].Name, name)
+				}
+			}
+		})
+	}
+}
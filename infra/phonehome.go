@@ -0,0 +1,201 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PhoneHomePort is the TCP port where cloud-init sends its phone home request
+// when it has finished, it must match the default value of the
+// phone_home_port variable of the terraform module
+const PhoneHomePort = 8642
+
+// A ReadyStatus tells if and when a machine has finished its cloud-init
+// setup
+type ReadyStatus struct {
+	Name    string
+	Address net.IP
+	Ready   bool
+	Elapsed time.Duration
+}
+
+// A ReadyCheck tells if cloud-init has already finished on a machine. Cloud-init
+// phones home only once, the check finds the machines that did it while
+// carcass was not listening.
+type ReadyCheck func(name string) bool
+
+// readyCheckInterval is the delay between two checks of the pending machines
+const readyCheckInterval = 10 * time.Second
+
+// WaitReady listens for the phone home requests of cloud-init on the gateway
+// address of the network, or the address of the host in bridge mode, until
+// all the given machines have called or the timeout is reached. When names is
+// empty, it waits for all the machines. The pending machines are also checked
+// with check, when it is not nil.
+func (i *Infrastructure) WaitReady(names []string, timeout time.Duration, check ReadyCheck) ([]ReadyStatus, error) {
+	if len(names) == 0 {
+		for _, m := range i.Machines {
+			names = append(names, m.Name)
+		}
+	}
+
+	var mu sync.Mutex
+
+	statuses := make([]ReadyStatus, 0, len(names))
+	byAddr := make(map[string]int)
+	for _, name := range names {
+		ip := i.MachineAddress(name)
+		if ip == nil {
+			return nil, fmt.Errorf("could not find the IP address of %s", name)
+		}
+		byAddr[ip.String()] = len(statuses)
+		statuses = append(statuses, ReadyStatus{Name: name, Address: ip})
+	}
+
+	start := time.Now()
+	pending := len(statuses)
+	done := make(chan struct{})
+
+	// must be called with mu held
+	setReady := func(n int) {
+		if statuses[n].Ready {
+			return
+		}
+
+		statuses[n].Ready = true
+		statuses[n].Elapsed = time.Since(start)
+		log.Printf("%s is ready", statuses[n].Name)
+
+		pending--
+		if pending == 0 {
+			close(done)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/phone-home/", func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			http.Error(w, "bad remote address", http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		n, ok := byAddr[host]
+		if !ok {
+			log.Printf("ignoring phone home from unknown address %s (%s)", host, r.FormValue("hostname"))
+			return
+		}
+
+		setReady(n)
+	})
+
+	// bridged networks have no address, cloud-init calls the host on the
+	// LAN
+	listen := i.Network.Address.Address
+	if i.Config.Module.HostAddress != "" {
+		listen = i.Config.Module.HostAddress
+	}
+
+	if listen == "" {
+		return nil, fmt.Errorf("could not listen for phone home: the address of the host on the LAN is unknown")
+	}
+
+	addr := net.JoinHostPort(listen, fmt.Sprint(PhoneHomePort))
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen for phone home: %w", err)
+	}
+
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+
+	stop := make(chan struct{})
+	var checker sync.WaitGroup
+	if check != nil {
+		checker.Add(1)
+		go func() {
+			defer checker.Done()
+			checkReady(statuses, &mu, check, setReady, stop)
+		}()
+	}
+
+	if pending > 0 {
+		select {
+		case <-done:
+		case <-time.After(timeout):
+		}
+	}
+
+	// the checker may be running a check, it must not update the
+	// statuses once they are returned
+	close(stop)
+	checker.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	late := make([]string, 0)
+	for _, s := range statuses {
+		if !s.Ready {
+			late = append(late, s.Name)
+		}
+	}
+
+	if len(late) > 0 {
+		return statuses, fmt.Errorf("timeout waiting for: %s", strings.Join(late, ", "))
+	}
+
+	return statuses, nil
+}
+
+// checkReady runs check on the pending machines until stop is closed,
+// setReady is called with mu held for the ones that are ready
+func checkReady(statuses []ReadyStatus, mu *sync.Mutex, check ReadyCheck, setReady func(int), stop chan struct{}) {
+	for {
+		for n := range statuses {
+			// a check can take seconds, do not start another one
+			// once stopped
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			mu.Lock()
+			ready := statuses[n].Ready
+			name := statuses[n].Name
+			mu.Unlock()
+
+			if ready || !check(name) {
+				continue
+			}
+
+			mu.Lock()
+			setReady(n)
+			mu.Unlock()
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(readyCheckInterval):
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/orgrim/carcass/hv"
+)
+
+// A StopStatus gives the final state of a machine after a shutdown request
+type StopStatus struct {
+	Name    string
+	State   string
+	Forced  bool
+	Elapsed time.Duration
+	Err     error
+}
+
+// Stopped tells if the machine is down
+func (s StopStatus) Stopped() bool {
+	return s.Err == nil && s.State == "shutoff"
+}
+
+func (s StopStatus) String() string {
+	if s.Err != nil {
+		// the state is unknown when it could not be queried
+		if s.State == "" {
+			return fmt.Sprintf("%s: error: %s", s.Name, s.Err)
+		}
+		return fmt.Sprintf("%s: %s, error: %s", s.Name, s.State, s.Err)
+	}
+
+	if s.Forced {
+		return fmt.Sprintf("%s: %s (destroyed after %s)", s.Name, s.State, s.Elapsed.Round(time.Second))
+	}
+
+	return fmt.Sprintf("%s: %s (%s)", s.Name, s.State, s.Elapsed.Round(time.Second))
+}
+
+// StopAllWait requests a graceful shutdown of all the machines at once and
+// waits for them to stop until the timeout is reached, see ShutdownWait. It
+// returns the final state of each machine.
+func (i *Infrastructure) StopAllWait(timeout time.Duration, destroy bool) []StopStatus {
+	statuses := make([]StopStatus, len(i.Machines))
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for n, m := range i.Machines {
+		statuses[n].Name = m.Name
+
+		wg.Add(1)
+		go func(s *StopStatus) {
+			defer wg.Done()
+
+			s.Forced, s.Err = i.shutdownWait(s.Name, timeout, destroy)
+			s.Elapsed = time.Since(start)
+
+			state, err := hv.DomainState(*i.HV, s.Name)
+			if err != nil {
+				if s.Err == nil {
+					s.Err = err
+				}
+				return
+			}
+			s.State = state
+		}(&statuses[n])
+	}
+
+	wg.Wait()
+
+	return statuses
+}
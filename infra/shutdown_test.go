@@ -0,0 +1,33 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package infra
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStopStatusString(t *testing.T) {
+	var tests = []struct {
+		status StopStatus
+		want   string
+	}{
+		{StopStatus{Name: "pg1", State: "shutoff", Elapsed: 3 * time.Second}, "pg1: shutoff (3s)"},
+		{StopStatus{Name: "pg1", State: "shutoff", Forced: true, Elapsed: time.Minute}, "pg1: shutoff (destroyed after 1m0s)"},
+		{StopStatus{Name: "pg1", State: "running", Err: errors.New("timeout")}, "pg1: running, error: timeout"},
+		{StopStatus{Name: "pg1", Err: errors.New("not found")}, "pg1: error: not found"},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got := st.status.String()
+			if got != st.want {
+				t.Errorf("got: %v, want %v", got, st.want)
+			}
+		})
+	}
+}
@@ -5,15 +5,22 @@
 package terraform
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/gohcl"
 	"github.com/hashicorp/hcl/v2/hclparse"
 	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	"github.com/zclconf/go-cty/cty/gocty"
 	"io"
+	"net"
 	"os"
 	"os/user"
+	"strconv"
+	"strings"
 )
 
 type Config struct {
@@ -28,26 +35,324 @@ type Provider struct {
 }
 
 type Module struct {
-	Name        string             `hcl:"name,label"`
-	Source      string             `hcl:"source"`
-	StoragePool string             `hcl:"storage_pool,optional"`
-	Username    string             `hcl:"user_name,optional"`
-	SshPubKey   string             `hcl:"user_pubkey,optional"`
-	Domain      string             `hcl:"dns_domain"`
-	NetworkName string             `hcl:"net_name,optional"`
-	NetworkCIDR string             `hcl:"net_cidr"`
-	Machines    map[string]Machine `hcl:"vms"` // hostname -> Machine
+	Name         string             `hcl:"name,label"`
+	Source       string             `hcl:"source"`
+	StoragePool  string             `hcl:"storage_pool,optional"`
+	Username     string             `hcl:"user_name,optional"`
+	SshPubKey    string             `hcl:"user_pubkey,optional"`
+	UserData     []string           `hcl:"user_data,optional"` // cloud-init fragments for all machines
+	Domain       string             `hcl:"dns_domain"`
+	NetworkName  string             `hcl:"net_name,optional"`
+	NetworkCIDR  string             `hcl:"net_cidr"`
+	NetworkCIDR6 string             `hcl:"net_cidr6,optional"`    // IPv6 network of dual-stack environments
+	NetworkMode  string             `hcl:"net_mode,optional"`     // nat, route, isolated or bridge, nat when empty
+	Bridge       string             `hcl:"net_bridge,optional"`   // bridge of the host in bridge mode
+	HostAddress  string             `hcl:"host_address,optional"` // address of the host on the LAN in bridge mode, for phone home
+	IPRange      string             `hcl:"ip_range,optional"`     // FIRST-LAST addresses of the LAN for the machines in bridge mode
+	Networks     map[string]Network `hcl:"networks,optional"`     // name -> extra network
+	DNSRecords   []DNSRecord        `hcl:"dns_records,optional"`  // aliases, SRV and TXT records
+	DiskBus      string             `hcl:"disk_bus,optional"`     // defaults of the machines
+	DiskCache    string             `hcl:"disk_cache,optional"`
+	DiskIO       string             `hcl:"disk_io,optional"`
+	NicModel     string             `hcl:"nic_model,optional"`
+	OvmfCode     string             `hcl:"ovmf_code,optional"` // UEFI firmware files of the hypervisor
+	OvmfVars     string             `hcl:"ovmf_vars,optional"` // templates of the variables, libvirt chooses them when empty
+	OvmfSbCode   string             `hcl:"ovmf_secure_code,optional"`
+	OvmfSbVars   string             `hcl:"ovmf_secure_vars,optional"`
+	NvramDir     string             `hcl:"nvram_dir,optional"` // where libvirt keeps the NVRAM files of the machines
+	Machines     map[string]Machine `hcl:"vms,optional"`       // hostname -> Machine, see ParseModuleConfig
+}
+
+// A Network is an extra isolated network of the environment, machines attach
+// to it with a Nic
+type Network struct {
+	CIDR string `cty:"cidr"`
+}
+
+// A DNSRecord is an extra name in the DNS of the network of the module
+type DNSRecord struct {
+	Type  string `cty:"type"`  // "alias", "srv" or "txt"
+	Name  string `cty:"name"`  // e.g. "primary" or "_postgresql._tcp"
+	Value string `cty:"value"` // machine of an alias, "machine:port[:priority:weight]" for SRV
+}
+
+// CheckNetwork verifies that the address range of a new extra network does not
+// overlap the ones of the networks of the module
+func (m Module) CheckNetwork(cidr string) error {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid network address: %w", err)
+	}
+
+	nets := map[string]string{m.NetworkName: m.NetworkCIDR}
+	for name, n := range m.Networks {
+		nets[name] = n.CIDR
+	}
+
+	for name, c := range nets {
+		_, other, err := net.ParseCIDR(c)
+		if err != nil {
+			continue
+		}
+
+		if other.Contains(ipnet.IP) || ipnet.Contains(other.IP) {
+			return fmt.Errorf("network %s overlaps network %s (%s)", ipnet, name, other)
+		}
+	}
+
+	return nil
 }
 
 // Since Machine is an object inside terraform, we need to use tags of the
 // lower level "github.com/zclconf/go-cty/cty" module used by hcl to load it.
 type Machine struct {
-	IPAddress    string `cty:"ip"`      // "10.10.0.3"
-	Distrib      string `cty:"distrib"` // "debian10"
-	Vcpus        int    `cty:"vcpu"`
-	Memory       int    `cty:"memory"`
-	DataDiskSize int    `cty:"data_size"`
-	Iface        string `cty:"iface"`
+	IPAddress  string     `cty:"ip"`      // "10.10.0.3"
+	IPAddress6 string     `cty:"ip6"`     // "fd00:10::3", on dual-stack environments
+	Distrib    string     `cty:"distrib"` // "debian10"
+	Vcpus      int        `cty:"vcpu"`
+	Memory     int        `cty:"memory"`
+	Disks      []DataDisk `cty:"disks"`
+	Iface      string     `cty:"iface"`
+	Nics       []Nic      `cty:"nics"`        // interfaces on extra networks
+	UserData   []string   `cty:"user_data"`   // cloud-init fragments
+	Groups     []string   `cty:"groups"`      // e.g. "db", to select machines
+	BootGroup  int        `cty:"boot_group"`  // lower groups start first
+	Instance   string     `cty:"instance_id"` // cloud-init instance-id, set on clones
+	DiskBus    string     `cty:"disk_bus"`    // "virtio", "scsi" or "sata", module default when empty
+	DiskCache  string     `cty:"disk_cache"`  // e.g. "none", "writeback"
+	DiskIO     string     `cty:"disk_io"`     // "native", "threads" or "io_uring"
+	NicModel   string     `cty:"nic_model"`   // e.g. "virtio", "e1000"
+	CpuMode    string     `cty:"cpu_mode"`    // "host-passthrough", "host-model" or "custom", libvirt default when empty
+	CpuModel   string     `cty:"cpu_model"`   // e.g. "Skylake-Server", with the custom mode
+	Sockets    int        `cty:"cpu_sockets"` // topology, not set when 0
+	Cores      int        `cty:"cpu_cores"`
+	Threads    int        `cty:"cpu_threads"`
+	Nested     bool       `cty:"nested"`        // allow the VM to host VMs
+	Firmware   string     `cty:"firmware"`      // "bios", "uefi" or "uefi-secure", bios when empty
+	Shares     []Share    `cty:"shares"`        // host directories mounted in the machine
+	GuestAgent bool       `cty:"guest_agent"`   // qemu guest agent channel, adding it recreates the domain
+	AgentPkg   bool       `cty:"agent_package"` // install the guest agent with cloud-init
+}
+
+// A Share is a directory of the host mounted inside a machine with virtiofs
+// or 9p
+type Share struct {
+	Source string `cty:"source"` // absolute path on the host
+	Target string `cty:"target"` // mount point in the machine
+	Driver string `cty:"driver"` // "virtiofs" or "9p"
+}
+
+// ParseNetMode reads the mode of the network of a module, given as nat,
+// route, isolated or bridge[:<bridge>]. It returns the mode and the bridge
+// of the host, br0 by default in bridge mode.
+func ParseNetMode(spec string) (string, string, error) {
+	mode, bridge := spec, ""
+	if i := strings.Index(spec, ":"); i != -1 {
+		mode, bridge = spec[:i], spec[i+1:]
+	}
+
+	switch mode {
+	case "nat", "route", "isolated":
+		if bridge != "" {
+			return "", "", fmt.Errorf("a bridge can only be given with the bridge mode")
+		}
+	case "bridge":
+		if bridge == "" {
+			bridge = "br0"
+		}
+	default:
+		return "", "", fmt.Errorf("invalid network mode: %s, expected one of [nat route isolated bridge[:<bridge>]]", mode)
+	}
+
+	return mode, bridge, nil
+}
+
+// CheckFirmware validates the firmware of a machine, empty means bios
+func CheckFirmware(firmware string) error {
+	switch firmware {
+	case "", "bios", "uefi", "uefi-secure":
+		return nil
+	}
+
+	return fmt.Errorf("invalid firmware: %s, expected one of [bios uefi uefi-secure]", firmware)
+}
+
+var (
+	diskBuses   = []string{"virtio", "scsi", "sata"}
+	diskCaches  = []string{"default", "none", "writethrough", "writeback", "directsync", "unsafe"}
+	diskIOModes = []string{"native", "threads", "io_uring"}
+	nicModels   = []string{"virtio", "e1000", "e1000e", "rtl8139"}
+)
+
+// CheckCPUOptions validates the CPU mode and model and the topology of a
+// machine. When the topology is given, it must match the number of vCPUs.
+func CheckCPUOptions(mode string, model string, sockets int, cores int, threads int, vcpus int) error {
+	switch mode {
+	case "", "host-passthrough", "host-model":
+		if model != "" {
+			return fmt.Errorf("a CPU model requires the custom CPU mode")
+		}
+	case "custom":
+		if model == "" {
+			return fmt.Errorf("the custom CPU mode requires a CPU model")
+		}
+	default:
+		return fmt.Errorf("invalid CPU mode: %s", mode)
+	}
+
+	if sockets == 0 && cores == 0 && threads == 0 {
+		return nil
+	}
+
+	if sockets <= 0 || cores <= 0 || threads <= 0 {
+		return fmt.Errorf("the CPU topology needs sockets, cores and threads")
+	}
+
+	if sockets*cores*threads != vcpus {
+		return fmt.Errorf("the CPU topology gives %d vCPUs instead of %d", sockets*cores*threads, vcpus)
+	}
+
+	return nil
+}
+
+// CheckDeviceOptions validates the disk bus, cache and IO modes and the NIC
+// model of a machine. Empty values are accepted, they mean the default.
+func CheckDeviceOptions(bus string, cache string, io string, model string) error {
+	checks := []struct {
+		what  string
+		value string
+		valid []string
+	}{
+		{"disk bus", bus, diskBuses},
+		{"disk cache mode", cache, diskCaches},
+		{"disk IO mode", io, diskIOModes},
+		{"NIC model", model, nicModels},
+	}
+
+	for _, c := range checks {
+		if c.value == "" {
+			continue
+		}
+
+		found := false
+		for _, v := range c.valid {
+			if c.value == v {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("invalid %s: %s, expected one of %v", c.what, c.value, c.valid)
+		}
+	}
+
+	// qemu refuses native AIO when the host page cache is used
+	if io == "native" && cache != "none" && cache != "directsync" {
+		return fmt.Errorf("disk IO mode native requires the none or directsync cache mode")
+	}
+
+	return nil
+}
+
+// CheckDNSRecord validates a DNS record, the machines targeted by aliases
+// and SRV records must exist in the module
+func (m Module) CheckDNSRecord(r DNSRecord) error {
+	if r.Name == "" || r.Value == "" {
+		return fmt.Errorf("a DNS record needs a name and a value")
+	}
+
+	switch r.Type {
+	case "alias":
+		if strings.ContainsAny(r.Name, ". _") {
+			return fmt.Errorf("invalid alias name: %s", r.Name)
+		}
+
+		if _, ok := m.Machines[r.Name]; ok {
+			return fmt.Errorf("alias %s is the name of a machine", r.Name)
+		}
+
+		if _, ok := m.Machines[r.Value]; !ok {
+			return fmt.Errorf("machine %s not found", r.Value)
+		}
+
+	case "srv":
+		labels := strings.Split(r.Name, ".")
+		if len(labels) != 2 || len(labels[0]) < 2 || labels[0][0] != '_' || (labels[1] != "_tcp" && labels[1] != "_udp") {
+			return fmt.Errorf("invalid SRV record name: %s, expected _service._tcp or _service._udp", r.Name)
+		}
+
+		fields := strings.Split(r.Value, ":")
+		if len(fields) != 2 && len(fields) != 4 {
+			return fmt.Errorf("invalid SRV record value: %s, expected machine:port[:priority:weight]", r.Value)
+		}
+
+		if _, ok := m.Machines[fields[0]]; !ok {
+			return fmt.Errorf("machine %s not found", fields[0])
+		}
+
+		if port, err := strconv.Atoi(fields[1]); err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port: %s", fields[1])
+		}
+
+		for _, f := range fields[2:] {
+			if v, err := strconv.Atoi(f); err != nil || v < 0 || v > 65535 {
+				return fmt.Errorf("invalid priority or weight: %s", f)
+			}
+		}
+
+	case "txt":
+		if strings.ContainsAny(r.Name, " _") {
+			return fmt.Errorf("invalid TXT record name: %s", r.Name)
+		}
+
+	default:
+		return fmt.Errorf("invalid DNS record type: %s, expected one of [alias srv txt]", r.Type)
+	}
+
+	return nil
+}
+
+// A Nic is an extra network interface of a machine, with a static IP address
+// on an extra network of the module
+type Nic struct {
+	Network   string `cty:"network"`
+	IPAddress string `cty:"ip"`
+	Mac       string `cty:"mac"`
+}
+
+// A DataDisk is an extra volume attached to a machine, in the storage pool of
+// the module when Pool is empty
+type DataDisk struct {
+	Size int64  `cty:"size"` // bytes
+	Pool string `cty:"pool"`
+}
+
+// DataVolumeName gives the name of the volume of the nth data disk of a
+// machine, as created by the terraform module
+func DataVolumeName(name string, domain string, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("data_volume-%s.%s.qcow2", name, domain)
+	}
+
+	return fmt.Sprintf("data_volume%d-%s.%s.qcow2", n, name, domain)
+}
+
+// DataVolumeKey gives the key of the terraform resource of the volume of the
+// nth data disk of a machine. The first one is keyed by the name of the
+// machine, the separator of the others cannot be part of a name.
+func DataVolumeKey(name string, n int) string {
+	if n == 0 {
+		return name
+	}
+
+	return fmt.Sprintf("%s_%d", name, n)
+}
+
+// OSVolumeName gives the name of the system volume of a machine, as created
+// by the terraform module
+func OSVolumeName(name string, domain string) string {
+	return fmt.Sprintf("os_volume-%s.%s.qcow2", name, domain)
 }
 
 type Meta struct {
@@ -64,6 +369,21 @@ type ProviderInfo struct {
 	Version string `cty:"version"`
 }
 
+// rawConfig is the configuration with the machines of the module left
+// undecoded, configurations written by older versions lack some of their
+// attributes
+type rawConfig struct {
+	Provider Provider  `hcl:"provider,block"`
+	Module   rawModule `hcl:"module,block"`
+	Meta     Meta      `hcl:"terraform,block"`
+}
+
+type rawModule struct {
+	Name     string    `hcl:"name,label"`
+	Machines cty.Value `hcl:"vms"`
+	Remain   hcl.Body  `hcl:",remain"`
+}
+
 func ParseModuleConfig(path string) (Config, error) {
 
 	parser := hclparse.NewParser()
@@ -81,18 +401,171 @@ func ParseModuleConfig(path string) (Config, error) {
 		return Config{}, fmt.Errorf("could not parse HCL configuration")
 	}
 
-	var c Config
-	moreDiags := gohcl.DecodeBody(f.Body, nil, &c)
+	var raw rawConfig
+	moreDiags := gohcl.DecodeBody(f.Body, nil, &raw)
 	diags = append(diags, moreDiags...)
 
+	c := Config{Provider: raw.Provider, Meta: raw.Meta}
+	if !moreDiags.HasErrors() {
+		moreDiags = gohcl.DecodeBody(raw.Module.Remain, nil, &c.Module)
+		diags = append(diags, moreDiags...)
+	}
+
 	if diags.HasErrors() {
 		wr.WriteDiagnostics(diags)
 		return Config{}, fmt.Errorf("could not parse HCL configuration")
 	}
 
+	machines, err := decodeMachines(raw.Module.Machines)
+	if err != nil {
+		return Config{}, err
+	}
+
+	c.Module.Name = raw.Module.Name
+	c.Module.Machines = machines
+
 	return c, nil
 }
 
+// decodeMachines decodes the vms attribute of the module, the attributes
+// missing from the machines get their zero value
+func decodeMachines(v cty.Value) (map[string]Machine, error) {
+	machines := make(map[string]Machine)
+	if v.IsNull() {
+		return machines, nil
+	}
+
+	if !v.Type().IsObjectType() && !v.Type().IsMapType() {
+		return nil, fmt.Errorf("invalid vms attribute: expected an object")
+	}
+
+	ty, err := gocty.ImpliedType(Machine{})
+	if err != nil {
+		return nil, err
+	}
+
+	for it := v.ElementIterator(); it.Next(); {
+		k, vm := it.Element()
+		name := k.AsString()
+
+		vm, err := withDefaults(migrateDataSize(vm), ty)
+		if err != nil {
+			return nil, fmt.Errorf("invalid machine %s: %w", name, err)
+		}
+
+		var m Machine
+		if err := gocty.FromCtyValue(vm, &m); err != nil {
+			return nil, fmt.Errorf("invalid machine %s: %w", name, err)
+		}
+
+		machines[name] = m
+	}
+
+	return machines, nil
+}
+
+// migrateDataSize replaces the data_size attribute of machines, from before
+// the support of several data disks, by the equivalent disks attribute. The
+// module used to create a data volume for every machine, even with a size of
+// 0, it becomes the first disk so that terraform keeps the volume and the
+// domain.
+func migrateDataSize(vm cty.Value) cty.Value {
+	ty := vm.Type()
+	if !ty.IsObjectType() || !ty.HasAttribute("data_size") || ty.HasAttribute("disks") {
+		return vm
+	}
+
+	attrs := vm.AsValueMap()
+	size := attrs["data_size"]
+	delete(attrs, "data_size")
+
+	if size.Type() != cty.Number || !size.IsKnown() || size.IsNull() {
+		size = cty.Zero
+	}
+
+	attrs["disks"] = cty.TupleVal([]cty.Value{
+		cty.ObjectVal(map[string]cty.Value{"size": size, "pool": cty.StringVal("")}),
+	})
+
+	return cty.ObjectVal(attrs)
+}
+
+// withDefaults converts v to ty, giving their zero value to the attributes
+// missing from objects. Unknown attributes are dropped.
+func withDefaults(v cty.Value, ty cty.Type) (cty.Value, error) {
+	if v.IsNull() {
+		return zeroValue(ty), nil
+	}
+
+	switch {
+	case ty.IsObjectType():
+		if !v.Type().IsObjectType() {
+			return cty.NilVal, fmt.Errorf("expected an object")
+		}
+
+		attrs := make(map[string]cty.Value)
+		for name, aty := range ty.AttributeTypes() {
+			if !v.Type().HasAttribute(name) {
+				attrs[name] = zeroValue(aty)
+				continue
+			}
+
+			av, err := withDefaults(v.GetAttr(name), aty)
+			if err != nil {
+				return cty.NilVal, fmt.Errorf("%s: %w", name, err)
+			}
+			attrs[name] = av
+		}
+
+		return cty.ObjectVal(attrs), nil
+
+	case ty.IsListType():
+		if !v.CanIterateElements() {
+			return cty.NilVal, fmt.Errorf("expected a list")
+		}
+
+		elems := make([]cty.Value, 0, v.LengthInt())
+		for it := v.ElementIterator(); it.Next(); {
+			_, e := it.Element()
+			e, err := withDefaults(e, ty.ElementType())
+			if err != nil {
+				return cty.NilVal, err
+			}
+			elems = append(elems, e)
+		}
+
+		if len(elems) == 0 {
+			return cty.ListValEmpty(ty.ElementType()), nil
+		}
+
+		return cty.ListVal(elems), nil
+	}
+
+	return convert.Convert(v, ty)
+}
+
+// zeroValue gives the empty value of a type of the attributes of a machine
+func zeroValue(ty cty.Type) cty.Value {
+	switch {
+	case ty == cty.String:
+		return cty.StringVal("")
+	case ty == cty.Number:
+		return cty.Zero
+	case ty == cty.Bool:
+		return cty.False
+	case ty.IsListType():
+		return cty.ListValEmpty(ty.ElementType())
+	case ty.IsObjectType():
+		attrs := make(map[string]cty.Value)
+		for name, aty := range ty.AttributeTypes() {
+			attrs[name] = zeroValue(aty)
+		}
+		return cty.ObjectVal(attrs)
+	}
+
+	return cty.NullVal(ty)
+}
+
 func WriteModuleConfig(dst io.Writer, conf Config) error {
 
 	f := hclwrite.NewEmptyFile()
@@ -118,6 +591,8 @@ func NewConfiguration(modulePath string, domain string, netCIDR string) (Config,
 	}
 
 	vms := make(map[string]Machine)
+	nets := make(map[string]Network)
+	userData := make([]string, 0)
 
 	mod := Module{
 		Name:        "carcass",
@@ -127,6 +602,10 @@ func NewConfiguration(modulePath string, domain string, netCIDR string) (Config,
 		Domain:      domain,
 		NetworkName: domain,
 		NetworkCIDR: netCIDR,
+		UserData:    userData,
+		Networks:    nets,
+		DiskBus:     "scsi",
+		NicModel:    "virtio",
 		Machines:    vms,
 	}
 
@@ -153,3 +632,290 @@ func NewConfiguration(modulePath string, domain string, netCIDR string) (Config,
 
 	return cfg, nil
 }
+
+// CheckIP verifies that ip can be given to the machine called name on a
+// network of the module, the main one when network is empty: it must be a
+// host address of the network, other than the gateway, and not used by
+// another machine
+func (m Module) CheckIP(network string, name string, ip string) error {
+	ipnet, used, err := m.networkUsage(network)
+	if err != nil {
+		return err
+	}
+
+	return checkIP(ipnet, used, name, ip)
+}
+
+// CheckIP6 verifies that an IPv6 address is usable by a machine on the IPv6
+// network of the module
+func (m Module) CheckIP6(name string, ip string) error {
+	ipnet, used, err := m.networkUsage6()
+	if err != nil {
+		return err
+	}
+
+	return checkIP(ipnet, used, name, ip)
+}
+
+func checkIP(ipnet *net.IPNet, used map[string]string, name string, ip string) error {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return fmt.Errorf("invalid IP address: %s", ip)
+	}
+
+	if !ipnet.Contains(addr) {
+		return fmt.Errorf("IP address %s is not in network %s", ip, ipnet)
+	}
+
+	first, last := hostRange(ipnet)
+	if addr.Equal(first) {
+		return fmt.Errorf("IP address %s is the gateway of the network", ip)
+	}
+
+	// IPv6 has no broadcast address, the last address of the prefix is a
+	// host address
+	if addr.Equal(ipnet.IP) || ipnet.IP.To4() != nil && addr.Equal(nextIP(last)) {
+		return fmt.Errorf("IP address %s is not a host address of network %s", ip, ipnet)
+	}
+
+	if n, ok := used[addr.String()]; ok && n != name {
+		return fmt.Errorf("IP address %s is already used by %s", ip, n)
+	}
+
+	return nil
+}
+
+// NextFreeIP finds the first address of a network of the module, the main one
+// when network is empty, that is neither the gateway nor used by a machine
+func (m Module) NextFreeIP(network string) (string, error) {
+	ipnet, used, err := m.networkUsage(network)
+	if err != nil {
+		return "", err
+	}
+
+	// the other addresses of a LAN may be used by anything, only the
+	// range reserved for the machines is safe
+	if network == "" && m.NetworkMode == "bridge" {
+		if m.IPRange == "" {
+			return "", fmt.Errorf("no range of addresses of the LAN is reserved for the VMs, the IP address must be given")
+		}
+
+		first, last, err := ParseIPRange(m.NetworkCIDR, m.IPRange)
+		if err != nil {
+			return "", err
+		}
+
+		if ip := freeIPInRange(first, last, used); ip != nil {
+			return ip.String(), nil
+		}
+
+		return "", fmt.Errorf("no free IP address left in range %s", m.IPRange)
+	}
+
+	return nextFreeIP(ipnet, used)
+}
+
+// ParseIPRange reads a range of addresses of a network, given as FIRST-LAST.
+// Both must be host addresses of the network, the gateway excluded.
+func ParseIPRange(cidr string, spec string) (net.IP, net.IP, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid network: %w", err)
+	}
+
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("invalid range %s, expected FIRST-LAST", spec)
+	}
+
+	bounds := make([]net.IP, 2)
+	for i, p := range parts {
+		if err := checkIP(ipnet, nil, "", p); err != nil {
+			return nil, nil, fmt.Errorf("invalid range %s: %w", spec, err)
+		}
+
+		ip := net.ParseIP(p)
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+		}
+		bounds[i] = ip
+	}
+
+	if bytes.Compare(bounds[0], bounds[1]) > 0 {
+		return nil, nil, fmt.Errorf("invalid range %s, the first address is after the last one", spec)
+	}
+
+	return bounds[0], bounds[1], nil
+}
+
+// NextFreeIP6 finds the first free address of the IPv6 network of the module
+func (m Module) NextFreeIP6() (string, error) {
+	ipnet, used, err := m.networkUsage6()
+	if err != nil {
+		return "", err
+	}
+
+	return nextFreeIP(ipnet, used)
+}
+
+func nextFreeIP(ipnet *net.IPNet, used map[string]string) (string, error) {
+	// the first host address is the gateway
+	first, last := hostRange(ipnet)
+	if ip := freeIPInRange(nextIP(first), last, used); ip != nil && ipnet.Contains(ip) {
+		return ip.String(), nil
+	}
+
+	return "", fmt.Errorf("no free IP address left in network %s", ipnet)
+}
+
+// freeIPInRange gives the first address between first and last, both
+// included, that is not used, nil when there is none
+func freeIPInRange(first net.IP, last net.IP, used map[string]string) net.IP {
+	for ip := first; bytes.Compare(ip, last) <= 0; ip = nextIP(ip) {
+		if _, ok := used[ip.String()]; !ok {
+			return ip
+		}
+
+		if ip.Equal(last) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// networkUsage6 finds the IPv6 network of the module and the addresses used
+// on it by the machines
+func (m Module) networkUsage6() (*net.IPNet, map[string]string, error) {
+	if m.NetworkCIDR6 == "" {
+		return nil, nil, fmt.Errorf("environment has no IPv6 network")
+	}
+
+	_, ipnet, err := net.ParseCIDR(m.NetworkCIDR6)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid IPv6 network of environment: %w", err)
+	}
+
+	used := make(map[string]string)
+	for name, vm := range m.Machines {
+		if ip := net.ParseIP(vm.IPAddress6); ip != nil {
+			used[ip.String()] = name
+		}
+	}
+
+	return ipnet, used, nil
+}
+
+// networkUsage finds the address of a network of the module, the main one when
+// network is empty, and the IP addresses used on it by the machines
+func (m Module) networkUsage(network string) (*net.IPNet, map[string]string, error) {
+	cidr := m.NetworkCIDR
+	if network != "" {
+		n, ok := m.Networks[network]
+		if !ok {
+			return nil, nil, fmt.Errorf("network %s not found in environment", network)
+		}
+		cidr = n.CIDR
+	}
+
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid network of environment: %w", err)
+	}
+
+	used := make(map[string]string)
+	if ip := net.ParseIP(m.HostAddress); ip != nil && network == "" {
+		used[ip.String()] = "the host"
+	}
+
+	for name, vm := range m.Machines {
+		if network == "" {
+			if ip := net.ParseIP(vm.IPAddress); ip != nil {
+				used[ip.String()] = name
+			}
+			continue
+		}
+
+		for _, nic := range vm.Nics {
+			if ip := net.ParseIP(nic.IPAddress); ip != nil && nic.Network == network {
+				used[ip.String()] = name
+			}
+		}
+	}
+
+	return ipnet, used, nil
+}
+
+// MacFromIP computes a MAC address for an interface from its IPv4 address,
+// using the locally administered prefix 52:54 of QEMU
+func MacFromIP(ip string) string {
+	addr := net.ParseIP(ip).To4()
+	if addr == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("52:54:%02x:%02x:%02x:%02x", addr[0], addr[1], addr[2], addr[3])
+}
+
+// hostRange computes the first and last host addresses of a network. The last
+// address of an IPv4 network is the broadcast address, IPv6 has none.
+func hostRange(ipnet *net.IPNet) (net.IP, net.IP) {
+	ip := ipnet.IP.To4()
+	if ip == nil {
+		ip = ipnet.IP
+	}
+
+	last := make(net.IP, len(ip))
+	for i := range ip {
+		last[i] = ip[i] | ^ipnet.Mask[i]
+	}
+
+	if len(ip) == net.IPv4len {
+		last = prevIP(last)
+	}
+
+	return nextIP(ip), last
+}
+
+// AddIP gives the IP address n addresses after ip, or an empty string when
+// ip is invalid
+func AddIP(ip string, n int) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+
+	if v4 := addr.To4(); v4 != nil {
+		addr = v4
+	}
+
+	for ; n > 0; n-- {
+		addr = nextIP(addr)
+	}
+
+	return addr.String()
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func prevIP(ip net.IP) net.IP {
+	prev := make(net.IP, len(ip))
+	copy(prev, ip)
+	for i := len(prev) - 1; i >= 0; i-- {
+		prev[i]--
+		if prev[i] != 0xff {
+			break
+		}
+	}
+	return prev
+}
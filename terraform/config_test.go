@@ -0,0 +1,563 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package terraform
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckIP(t *testing.T) {
+	m := Module{
+		NetworkCIDR: "10.0.10.0/24",
+		Networks: map[string]Network{
+			"repl": {CIDR: "10.0.20.0/24"},
+		},
+		Machines: map[string]Machine{
+			"pg1": {
+				IPAddress: "10.0.10.2",
+				Nics:      []Nic{{Network: "repl", IPAddress: "10.0.20.2"}},
+			},
+		},
+	}
+
+	var tests = []struct {
+		network string
+		name    string
+		input   string
+		valid   bool
+	}{
+		{"", "pg2", "10.0.10.3", true},
+		{"", "pg1", "10.0.10.2", true},
+		{"", "pg2", "10.0.10.2", false},
+		{"", "pg2", "10.0.10.1", false},
+		{"", "pg2", "10.0.10.0", false},
+		{"", "pg2", "10.0.10.255", false},
+		{"", "pg2", "10.0.11.3", false},
+		{"", "pg2", "10.0.10", false},
+		{"repl", "pg2", "10.0.20.3", true},
+		{"repl", "pg2", "10.0.20.2", false},
+		{"repl", "pg2", "10.0.10.3", false},
+		{"storage", "pg2", "10.0.30.3", false},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			err := m.CheckIP(st.network, st.name, st.input)
+			if (err == nil) != st.valid {
+				t.Errorf("got: %v, want valid %v", err, st.valid)
+			}
+		})
+	}
+}
+
+func TestNextFreeIP(t *testing.T) {
+	var tests = []struct {
+		cidr string
+		used []string
+		want string
+	}{
+		{"10.0.10.0/24", []string{}, "10.0.10.2"},
+		{"10.0.10.0/24", []string{"10.0.10.2", "10.0.10.4"}, "10.0.10.3"},
+		{"10.0.10.0/30", []string{}, "10.0.10.2"},
+		{"10.0.10.0/30", []string{"10.0.10.2"}, ""},
+		{"10.0.10.0/23", []string{}, "10.0.10.2"},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			m := Module{NetworkCIDR: st.cidr, Machines: make(map[string]Machine)}
+			for n, ip := range st.used {
+				m.Machines[fmt.Sprintf("vm%d", n)] = Machine{IPAddress: ip}
+			}
+
+			got, err := m.NextFreeIP("")
+			if st.want == "" {
+				if err == nil {
+					t.Errorf("got: %v, want an error", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if got != st.want {
+				t.Errorf("got: %v, want %v", got, st.want)
+			}
+		})
+	}
+}
+
+func TestNextFreeIPBridge(t *testing.T) {
+	var tests = []struct {
+		ipRange string
+		host    string
+		used    []string
+		want    string
+	}{
+		{"", "192.168.1.10", []string{}, ""},
+		{"192.168.1.100-192.168.1.102", "192.168.1.10", []string{}, "192.168.1.100"},
+		{"192.168.1.100-192.168.1.102", "192.168.1.100", []string{"192.168.1.101"}, "192.168.1.102"},
+		{"192.168.1.100-192.168.1.101", "192.168.1.10", []string{"192.168.1.100", "192.168.1.101"}, ""},
+		{"192.168.1.101-192.168.1.100", "192.168.1.10", []string{}, ""},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			m := Module{
+				NetworkCIDR: "192.168.1.0/24",
+				NetworkMode: "bridge",
+				HostAddress: st.host,
+				IPRange:     st.ipRange,
+				Machines:    make(map[string]Machine),
+			}
+			for n, ip := range st.used {
+				m.Machines[fmt.Sprintf("vm%d", n)] = Machine{IPAddress: ip}
+			}
+
+			got, err := m.NextFreeIP("")
+			if st.want == "" {
+				if err == nil {
+					t.Errorf("got: %v, want an error", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if got != st.want {
+				t.Errorf("got: %v, want %v", got, st.want)
+			}
+		})
+	}
+}
+
+func TestParseIPRange(t *testing.T) {
+	var tests = []struct {
+		spec  string
+		first string
+		last  string
+		fail  bool
+	}{
+		{"10.0.10.100-10.0.10.200", "10.0.10.100", "10.0.10.200", false},
+		{"10.0.10.100-10.0.10.100", "10.0.10.100", "10.0.10.100", false},
+		{"10.0.10.200-10.0.10.100", "", "", true},
+		{"10.0.10.1-10.0.10.20", "", "", true},
+		{"10.0.10.100-10.0.11.20", "", "", true},
+		{"10.0.10.100", "", "", true},
+		{"10.0.10.100-", "", "", true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			first, last, err := ParseIPRange("10.0.10.0/24", st.spec)
+			if (err != nil) != st.fail {
+				t.Errorf("got: %v, want failure %v", err, st.fail)
+			}
+			if st.fail {
+				return
+			}
+			if first.String() != st.first || last.String() != st.last {
+				t.Errorf("got: %v-%v, want %v-%v", first, last, st.first, st.last)
+			}
+		})
+	}
+}
+
+func TestNextFreeIP6(t *testing.T) {
+	var tests = []struct {
+		cidr string
+		used []string
+		want string
+	}{
+		{"fd00:10::/64", []string{}, "fd00:10::2"},
+		{"fd00:10::/64", []string{"fd00:10::2", "fd00:10:0:0::3"}, "fd00:10::4"},
+		{"fd00:10::/126", []string{"fd00:10::2"}, "fd00:10::3"},
+		{"fd00:10::/126", []string{"fd00:10::2", "fd00:10::3"}, ""},
+		{"", []string{}, ""},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			m := Module{NetworkCIDR6: st.cidr, Machines: make(map[string]Machine)}
+			for n, ip := range st.used {
+				m.Machines[fmt.Sprintf("vm%d", n)] = Machine{IPAddress6: ip}
+			}
+
+			got, err := m.NextFreeIP6()
+			if st.want == "" {
+				if err == nil {
+					t.Errorf("got: %v, want an error", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if got != st.want {
+				t.Errorf("got: %v, want %v", got, st.want)
+			}
+		})
+	}
+}
+
+func TestAddIP(t *testing.T) {
+	var tests = []struct {
+		ip   string
+		n    int
+		want string
+	}{
+		{"10.0.10.2", 0, "10.0.10.2"},
+		{"10.0.10.2", 3, "10.0.10.5"},
+		{"10.0.10.254", 2, "10.0.11.0"},
+		{"10.0.255.255", 1, "10.1.0.0"},
+		{"fd00:10::2", 2, "fd00:10::4"},
+		{"fd00:10::ffff", 1, "fd00:10::1:0"},
+		{"10.0.10", 1, ""},
+		{"", 1, ""},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got := AddIP(st.ip, st.n)
+			if got != st.want {
+				t.Errorf("got: %v, want %v", got, st.want)
+			}
+		})
+	}
+}
+
+func TestCheckIP6(t *testing.T) {
+	m := Module{
+		NetworkCIDR6: "fd00:10::/64",
+		Machines: map[string]Machine{
+			"pg1": {IPAddress6: "fd00:10::2"},
+		},
+	}
+
+	var tests = []struct {
+		name  string
+		input string
+		valid bool
+	}{
+		{"pg2", "fd00:10::3", true},
+		{"pg1", "fd00:10::2", true},
+		{"pg2", "fd00:10::2", false},
+		{"pg2", "fd00:10::1", false},
+		{"pg2", "fd00:10::", false},
+		{"pg2", "fd00:10::ffff:ffff:ffff:ffff", true},
+		{"pg2", "fd00:20::3", false},
+		{"pg2", "10.0.10.3", false},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			err := m.CheckIP6(st.name, st.input)
+			if (err == nil) != st.valid {
+				t.Errorf("got: %v, want valid %v", err, st.valid)
+			}
+		})
+	}
+}
+
+func TestMacFromIP(t *testing.T) {
+	var tests = []struct {
+		input string
+		want  string
+	}{
+		{"10.0.20.2", "52:54:0a:00:14:02"},
+		{"192.168.122.254", "52:54:c0:a8:7a:fe"},
+		{"fd00::2", ""},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got := MacFromIP(st.input)
+			if got != st.want {
+				t.Errorf("got: %v, want %v", got, st.want)
+			}
+		})
+	}
+}
+
+func TestCheckDeviceOptions(t *testing.T) {
+	var tests = []struct {
+		bus   string
+		cache string
+		io    string
+		model string
+		fail  bool
+	}{
+		{"", "", "", "", false},
+		{"virtio", "writeback", "threads", "e1000", false},
+		{"sata", "none", "native", "virtio", false},
+		{"ide", "", "", "", true},
+		{"", "always", "", "", true},
+		{"", "", "native", "", true},
+		{"", "writeback", "native", "", true},
+		{"", "", "", "ne2k", true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			err := CheckDeviceOptions(st.bus, st.cache, st.io, st.model)
+			if (err != nil) != st.fail {
+				t.Errorf("got: %v, want failure %v", err, st.fail)
+			}
+		})
+	}
+}
+
+func TestCheckCPUOptions(t *testing.T) {
+	var tests = []struct {
+		mode    string
+		model   string
+		sockets int
+		cores   int
+		threads int
+		vcpus   int
+		fail    bool
+	}{
+		{"", "", 0, 0, 0, 2, false},
+		{"host-passthrough", "", 2, 4, 2, 16, false},
+		{"custom", "Skylake-Server", 1, 2, 1, 2, false},
+		{"custom", "", 0, 0, 0, 2, true},
+		{"host-model", "Skylake-Server", 0, 0, 0, 2, true},
+		{"maximum", "", 0, 0, 0, 2, true},
+		{"", "", 2, 0, 0, 2, true},
+		{"", "", 2, 2, 1, 2, true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			err := CheckCPUOptions(st.mode, st.model, st.sockets, st.cores, st.threads, st.vcpus)
+			if (err != nil) != st.fail {
+				t.Errorf("got: %v, want failure %v", err, st.fail)
+			}
+		})
+	}
+}
+
+func TestCheckDNSRecord(t *testing.T) {
+	m := Module{
+		Machines: map[string]Machine{
+			"pg1": {IPAddress: "10.0.10.2"},
+			"pg2": {IPAddress: "10.0.10.3"},
+		},
+	}
+
+	var tests = []struct {
+		input DNSRecord
+		fail  bool
+	}{
+		{DNSRecord{"alias", "primary", "pg1"}, false},
+		{DNSRecord{"alias", "primary", "pg3"}, true},
+		{DNSRecord{"alias", "pg2", "pg1"}, true},
+		{DNSRecord{"alias", "pri.mary", "pg1"}, true},
+		{DNSRecord{"srv", "_postgresql._tcp", "pg1:5432"}, false},
+		{DNSRecord{"srv", "_postgresql._tcp", "pg2:5432:10:5"}, false},
+		{DNSRecord{"srv", "_postgresql._tcp", "pg2:5432:10"}, true},
+		{DNSRecord{"srv", "_postgresql._tcp", "pg1:70000"}, true},
+		{DNSRecord{"srv", "postgresql.tcp", "pg1:5432"}, true},
+		{DNSRecord{"srv", "_postgresql._sctp", "pg1:5432"}, true},
+		{DNSRecord{"txt", "cluster", "primary=pg1"}, false},
+		{DNSRecord{"txt", "cluster", ""}, true},
+		{DNSRecord{"cname", "primary", "pg1"}, true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			err := m.CheckDNSRecord(st.input)
+			if (err != nil) != st.fail {
+				t.Errorf("got: %v, want failure %v", err, st.fail)
+			}
+		})
+	}
+}
+
+func TestParseNetMode(t *testing.T) {
+	var tests = []struct {
+		input  string
+		mode   string
+		bridge string
+		fail   bool
+	}{
+		{"nat", "nat", "", false},
+		{"route", "route", "", false},
+		{"isolated", "isolated", "", false},
+		{"bridge", "bridge", "br0", false},
+		{"bridge:virbr1", "bridge", "virbr1", false},
+		{"nat:br0", "", "", true},
+		{"open", "", "", true},
+		{"", "", "", true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			mode, bridge, err := ParseNetMode(st.input)
+			if (err != nil) != st.fail {
+				t.Errorf("got: %v, want failure %v", err, st.fail)
+			}
+
+			if mode != st.mode || bridge != st.bridge {
+				t.Errorf("got: %v %v, want %v %v", mode, bridge, st.mode, st.bridge)
+			}
+		})
+	}
+}
+
+// baselineConfig is a main.tf written before the machines had data disks,
+// extra networks and devices options
+const baselineConfig = `provider "libvirt" {
+  uri = "qemu:///system"
+}
+
+module "carcass" {
+  source       = "/home/carcass/.local/share/carcass/terraform/bones"
+  storage_pool = "default"
+  user_name    = "carcass"
+  user_pubkey  = "ssh-ed25519 AAAA carcass@host"
+  dns_domain   = "lab"
+  net_name     = "lab"
+  net_cidr     = "10.10.0.0/24"
+  vms = {
+    pg1 = {
+      data_size = 5368709120
+      distrib   = "debian10"
+      iface     = "ens3"
+      ip        = "10.10.0.2"
+      memory    = 1024
+      vcpu      = 1
+    }
+    pg2 = {
+      data_size = 0
+      distrib   = "debian10"
+      iface     = "ens3"
+      ip        = "10.10.0.3"
+      memory    = 1024
+      vcpu      = 2
+    }
+  }
+}
+
+terraform {
+  required_version = ">= 0.13"
+  required_providers {
+    libvirt = {
+      source  = "dmacvicar/libvirt"
+      version = "~> 0.6.3"
+    }
+  }
+}
+`
+
+func TestParseModuleConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "main.tf")
+	if err := os.WriteFile(path, []byte(baselineConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := ParseModuleConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if c.Module.Name != "carcass" || c.Module.NetworkCIDR != "10.10.0.0/24" {
+		t.Errorf("got: %v %v, want carcass 10.10.0.0/24", c.Module.Name, c.Module.NetworkCIDR)
+	}
+
+	var tests = []struct {
+		name  string
+		ip    string
+		vcpus int
+		disks []DataDisk
+	}{
+		{"pg1", "10.10.0.2", 1, []DataDisk{{Size: 5368709120}}},
+		// the volume of the first disk always existed, it must not be
+		// destroyed
+		{"pg2", "10.10.0.3", 2, []DataDisk{{Size: 0}}},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			m, ok := c.Module.Machines[st.name]
+			if !ok {
+				t.Fatalf("machine %s not found", st.name)
+			}
+
+			if m.IPAddress != st.ip || m.Vcpus != st.vcpus {
+				t.Errorf("got: %v %v, want %v %v", m.IPAddress, m.Vcpus, st.ip, st.vcpus)
+			}
+
+			if fmt.Sprintf("%v", m.Disks) != fmt.Sprintf("%v", st.disks) {
+				t.Errorf("got: %v, want %v", m.Disks, st.disks)
+			}
+
+			if m.Groups == nil || m.Shares == nil || m.DiskBus != "" || m.IPAddress6 != "" {
+				t.Errorf("got: %+v, want empty values for the missing attributes", m)
+			}
+		})
+	}
+
+	// the configuration written back is read again as is
+	out := filepath.Join(t.TempDir(), "main.tf")
+	f, err := os.Create(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteModuleConfig(f, c); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	c2, err := ParseModuleConfig(out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if fmt.Sprintf("%+v", c2.Module) != fmt.Sprintf("%+v", c.Module) {
+		t.Errorf("got: %+v, want %+v", c2.Module, c.Module)
+	}
+}
+
+func TestCheckNetwork(t *testing.T) {
+	m := Module{
+		NetworkName: "lab",
+		NetworkCIDR: "10.0.10.0/24",
+		Networks: map[string]Network{
+			"repl": {CIDR: "10.0.20.0/24"},
+		},
+	}
+
+	var tests = []struct {
+		input string
+		valid bool
+	}{
+		{"10.0.30.0/24", true},
+		{"10.0.11.0/24", true},
+		{"10.0.10.128/25", false},
+		{"10.0.0.0/16", false},
+		{"10.0.20.0/24", false},
+		{"10.0.30.0", false},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			err := m.CheckNetwork(st.input)
+			if (err == nil) != st.valid {
+				t.Errorf("got: %v, want valid %v", err, st.valid)
+			}
+		})
+	}
+}
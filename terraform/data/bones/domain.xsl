@@ -0,0 +1,121 @@
+<?xml version="1.0" ?>
+<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+  <xsl:output omit-xml-declaration="yes" indent="yes"/>
+
+  <!-- copy everything by default -->
+  <xsl:template match="node()|@*">
+    <xsl:copy>
+      <xsl:apply-templates select="node()|@*"/>
+    </xsl:copy>
+  </xsl:template>
+%{ if disk_bus == "sata" ~}
+
+  <!-- the provider only knows about virtio and scsi -->
+  <xsl:template match="/domain/devices/disk[@device='disk']/target">
+    <xsl:copy>
+      <xsl:attribute name="dev">
+        <xsl:value-of select="concat('sd', substring('abcdefghijklmnopqrstuvwxyz', count(../preceding-sibling::disk[@device='disk']) + 1, 1))"/>
+      </xsl:attribute>
+      <xsl:attribute name="bus">sata</xsl:attribute>
+    </xsl:copy>
+  </xsl:template>
+%{ endif ~}
+%{ if disk_cache != "" || disk_io != "" ~}
+
+  <xsl:template match="/domain/devices/disk[@device='disk']/driver">
+    <xsl:copy>
+      <xsl:apply-templates select="@*"/>
+%{ if disk_cache != "" ~}
+      <xsl:attribute name="cache">${disk_cache}</xsl:attribute>
+%{ endif ~}
+%{ if disk_io != "" ~}
+      <xsl:attribute name="io">${disk_io}</xsl:attribute>
+%{ endif ~}
+      <xsl:apply-templates select="node()"/>
+    </xsl:copy>
+  </xsl:template>
+%{ endif ~}
+%{ if cpu_mode != "" || sockets > 0 ~}
+
+  <!-- replace the CPU definition of the provider -->
+  <xsl:template match="/domain/cpu"/>
+%{ endif ~}
+%{ if length(virtiofs) > 0 ~}
+
+  <!-- virtiofs needs the memory of the VM to be shared with virtiofsd -->
+  <xsl:template match="/domain/memoryBacking"/>
+
+  <xsl:template match="/domain/devices">
+    <xsl:copy>
+      <xsl:apply-templates select="@*|node()"/>
+%{ for fs in virtiofs ~}
+      <filesystem type="mount" accessmode="passthrough">
+        <driver type="virtiofs"/>
+        <source dir="${fs.source}"/>
+        <target dir="${fs.tag}"/>
+      </filesystem>
+%{ endfor ~}
+    </xsl:copy>
+  </xsl:template>
+%{ endif ~}
+%{ if cpu_mode != "" || sockets > 0 || length(virtiofs) > 0 ~}
+
+  <xsl:template match="/domain">
+    <xsl:copy>
+      <xsl:apply-templates select="@*|node()"/>
+%{ if cpu_mode != "" || sockets > 0 ~}
+      <cpu%{ if cpu_mode != "" } mode="${cpu_mode}"%{ endif }%{ if cpu_mode == "custom" } match="exact"%{ endif }>
+%{ if cpu_mode == "custom" ~}
+        <model fallback="allow">${cpu_model}</model>
+%{ endif ~}
+%{ if sockets > 0 ~}
+        <topology sockets="${sockets}" cores="${cores}" threads="${threads}"/>
+%{ endif ~}
+%{ if nested && cpu_mode != "host-passthrough" ~}
+        <!-- only the feature of the vendor of the host is enabled -->
+        <feature policy="optional" name="vmx"/>
+        <feature policy="optional" name="svm"/>
+%{ endif ~}
+      </cpu>
+%{ endif ~}
+%{ if length(virtiofs) > 0 ~}
+      <memoryBacking>
+        <source type="memfd"/>
+        <access mode="shared"/>
+      </memoryBacking>
+%{ endif ~}
+    </xsl:copy>
+  </xsl:template>
+%{ endif ~}
+%{ if secure_boot ~}
+
+  <xsl:template match="/domain/os/loader">
+    <xsl:copy>
+      <xsl:apply-templates select="@*"/>
+      <xsl:attribute name="secure">yes</xsl:attribute>
+      <xsl:apply-templates select="node()"/>
+    </xsl:copy>
+  </xsl:template>
+
+  <xsl:template match="/domain/features">
+    <xsl:copy>
+      <xsl:apply-templates select="@*|node()[not(self::smm)]"/>
+      <smm state="on"/>
+    </xsl:copy>
+  </xsl:template>
+
+  <!-- q35 has no IDE bus for the cloud-init cdrom -->
+  <xsl:template match="/domain/devices/disk[@device='cdrom']/target">
+    <target dev="sdz" bus="sata"/>
+  </xsl:template>
+%{ endif ~}
+%{ if nic_model != "virtio" ~}
+
+  <xsl:template match="/domain/devices/interface">
+    <xsl:copy>
+      <xsl:apply-templates select="@*|node()[not(self::model)]"/>
+      <model type="${nic_model}"/>
+    </xsl:copy>
+  </xsl:template>
+%{ endif ~}
+</xsl:stylesheet>
@@ -2,25 +2,107 @@
 # l'accès depuis la machine, on peut soit configurer un dnsmasq et
 # modifier son /etc/resolv.conf, soit ajouter des entrées dans
 # /etc/hosts
+locals {
+  # isolated correspond au mode none du provider. En mode bridge, le
+  # réseau est celui du LAN : libvirt n'y gère ni adresse ni DNS
+  net_mode = var.net_mode == "isolated" ? "none" : coalesce(var.net_mode, "nat")
+  bridged = var.net_mode == "bridge"
+
+  # réseau IPv6 des environnements dual-stack, la passerelle est la première
+  # adresse comme en IPv4
+  net_cidr6 = var.net_cidr6 != null ? var.net_cidr6 : ""
+  vms6 = { for name, vm in var.vms : name => vm if vm.ip6 != "" }
+}
+
 resource "libvirt_network" "network" {
   name = var.net_name
-  mode = "nat"
-  domain = var.dns_domain
-  addresses = [ var.net_cidr ]
-  dns {
-    enabled = true
-    dynamic "hosts" {
-      for_each = var.vms
-      content {
-        hostname = "${hosts.key}.${var.dns_domain}"
-        ip = hosts.value.ip
+  mode = local.net_mode
+  bridge = local.bridged ? coalesce(var.net_bridge, "br0") : null
+  domain = local.bridged ? null : var.dns_domain
+  addresses = local.bridged ? null : compact([ var.net_cidr, local.net_cidr6 ])
+
+  dynamic "dns" {
+    for_each = local.bridged ? [] : [ 1 ]
+    content {
+      enabled = true
+      dynamic "hosts" {
+        for_each = var.vms
+        content {
+          hostname = "${hosts.key}.${var.dns_domain}"
+          ip = hosts.value.ip
+        }
+      }
+
+      # enregistrements AAAA
+      dynamic "hosts" {
+        for_each = local.vms6
+        content {
+          hostname = "${hosts.key}.${var.dns_domain}"
+          ip = hosts.value.ip6
+        }
+      }
+
+      # alias d'une VM, déplacé d'une VM à l'autre lors des bascules
+      dynamic "hosts" {
+        for_each = [ for r in local.dns_records : r if r.type == "alias" ]
+        content {
+          hostname = "${hosts.value.name}.${var.dns_domain}"
+          ip = var.vms[hosts.value.value].ip
+        }
+      }
+
+      dynamic "hosts" {
+        for_each = [ for r in local.dns_records : r if r.type == "alias" && contains(keys(local.vms6), r.value) ]
+        content {
+          hostname = "${hosts.value.name}.${var.dns_domain}"
+          ip = local.vms6[hosts.value.value].ip6
+        }
+      }
+
+      # la valeur est vm:port[:priorité:poids]
+      dynamic "srvs" {
+        for_each = [ for r in local.dns_records : merge(r, { fields = split(":", r.value) }) if r.type == "srv" ]
+        content {
+          service = trimprefix(split(".", srvs.value.name)[0], "_")
+          protocol = trimprefix(split(".", srvs.value.name)[1], "_")
+          domain = var.dns_domain
+          target = "${srvs.value.fields[0]}.${var.dns_domain}"
+          port = srvs.value.fields[1]
+          priority = length(srvs.value.fields) > 2 ? srvs.value.fields[2] : "0"
+          weight = length(srvs.value.fields) > 3 ? srvs.value.fields[3] : "0"
+        }
       }
+
+      # le provider ne gère pas les enregistrements TXT, carcass les ajoute
+      # directement au réseau
     }
   }
+
+  dhcp {
+    enabled = false
+  }
+  autostart = true
+}
+
+# Réseaux supplémentaires isolés, sans DNS ni DHCP : les VMs y ont une
+# adresse IP statique configurée par cloud-init
+locals {
+  networks = var.networks != null ? var.networks : {}
+  dns_records = var.dns_records != null ? var.dns_records : []
+}
+
+resource "libvirt_network" "extra" {
+  name = "${var.net_name}_${each.key}"
+  mode = "none"
+  addresses = [ each.value.cidr ]
+  dns {
+    enabled = false
+  }
   dhcp {
     enabled = false
   }
   autostart = true
+  for_each = local.networks
 }
 
 # distrib-base.qcow2 must exist in the storage pool
@@ -30,42 +112,166 @@ resource "libvirt_volume" "os_volume" {
   base_volume_pool = var.storage_pool
   pool = var.storage_pool
   for_each = var.vms
+
+  # carcass vm clone copies the volume of another VM and imports it, it has
+  # no base volume
+  lifecycle {
+    ignore_changes = [ base_volume_name, base_volume_pool, base_volume_id ]
+  }
+}
+
+# Un volume par disque de données de chaque VM. Le premier disque d'une
+# VM garde la clé et le nom utilisés quand il n'y avait qu'un disque de
+# données par VM. Le séparateur des autres clés ne peut pas faire partie
+# du nom d'une VM
+locals {
+  data_disks = { for d in flatten([
+    for name, vm in var.vms : [
+      for i, disk in vm.disks : {
+        key = i == 0 ? name : "${name}_${i}"
+        name = i == 0 ? "data_volume-${name}.${var.dns_domain}.qcow2" : "data_volume${i}-${name}.${var.dns_domain}.qcow2"
+        pool = disk.pool != "" ? disk.pool : var.storage_pool
+        size = disk.size
+      }
+    ]
+  ]) : d.key => d }
 }
 
 resource "libvirt_volume" "data_volume" {
-  name = "data_volume-${each.key}.${var.dns_domain}.qcow2"
-  pool = var.storage_pool
+  name = each.value.name
+  pool = each.value.pool
 
-  size  = each.value.data_size
-  for_each = var.vms
+  size  = each.value.size
+  for_each = local.data_disks
+
+  # carcass vm set grows the volume, do not recreate it
+  lifecycle {
+    ignore_changes = [ size ]
+  }
 }
 
 
+# Bus, modes de cache et d'IO des disques, modèle des interfaces et CPU de
+# chaque VM, avec les valeurs par défaut du module
+locals {
+  devices = { for name, vm in var.vms : name => {
+    disk_bus = coalesce(vm.disk_bus, var.disk_bus, "scsi")
+    disk_cache = vm.disk_cache != "" ? vm.disk_cache : (var.disk_cache != null ? var.disk_cache : "")
+    disk_io = vm.disk_io != "" ? vm.disk_io : (var.disk_io != null ? var.disk_io : "")
+    nic_model = coalesce(vm.nic_model, var.nic_model, "virtio")
+    # la virtualisation imbriquée passe le CPU de l'hôte par défaut
+    cpu_mode = vm.cpu_mode != "" ? vm.cpu_mode : (vm.nested ? "host-passthrough" : "")
+    cpu_model = vm.cpu_model
+    sockets = vm.cpu_sockets
+    cores = vm.cpu_cores
+    threads = vm.cpu_threads
+    nested = vm.nested
+    secure_boot = vm.firmware == "uefi-secure"
+    virtiofs = [ for i, sh in vm.shares : { tag = "share${i}", source = sh.source } if sh.driver == "virtiofs" ]
+  } }
+
+  # firmware UEFI et fichier NVRAM propre à chaque VM, SeaBIOS sinon. Sans
+  # template, libvirt prend celui qui correspond au firmware
+  firmwares = { for name, vm in var.vms : name => {
+    code = vm.firmware == "uefi-secure" ? var.ovmf_secure_code : var.ovmf_code
+    vars = vm.firmware == "uefi-secure" ? var.ovmf_secure_vars : var.ovmf_vars
+    nvram = "${var.nvram_dir}/${name}.${var.dns_domain}_VARS.fd"
+  } if vm.firmware == "uefi" || vm.firmware == "uefi-secure" }
+
+  # la définition du domaine n'est transformée que si nécessaire
+  custom_domains = { for name, d in local.devices : name => d
+    if d.disk_bus == "sata" || d.disk_cache != "" || d.disk_io != "" || d.nic_model != "virtio" || d.cpu_mode != "" || d.sockets > 0 || d.nested || d.secure_boot || length(d.virtiofs) > 0
+  }
+}
+
 # Cloud Init
-data "template_file" "ci_user_data" {
-  template = file("${path.module}/cloud_init_user_data")
-  vars = {
+locals {
+  ci_user_data = { for name, vm in var.vms : name => templatefile("${path.module}/cloud_init_user_data", {
     username = var.user_name
     ssh_pubkey = var.user_pubkey
-  }
+    phone_home_host = var.host_address != "" ? var.host_address : cidrhost(var.net_cidr, 1)
+    phone_home_port = var.phone_home_port
+    agent_package = vm.agent_package
+    # les disques de données suivent le disque système sda ou vda
+    data_devices = [ for i, disk in vm.disks : "/dev/${local.devices[name].disk_bus == "virtio" ? "vd" : "sd"}${substr("bcdefghijklmnopqrstuvwxyz", i, 1)}" ]
+    # répertoires partagés de l'hôte, le tag est le nom de montage
+    shares = [ for i, sh in vm.shares : {
+      tag = "share${i}"
+      target = sh.target
+      fstype = sh.driver
+      options = sh.driver == "9p" ? "trans=virtio,version=9p2000.L,nofail" : "defaults,nofail"
+    } ]
+  }) }
 }
 
 data "template_file"  "ci_meta_data" {
   template = file("${path.module}/cloud_init_meta_data")
   vars = {
     hostname = "${each.key}.${var.dns_domain}"
+    instance_id = each.value.instance_id
   }
   for_each = var.vms
 }
 
-data "template_file"  "ci_network_config" {
-  template = file("${path.module}/cloud_init_network_config")
-  vars = {
-    ip = each.value.ip
+locals {
+  ci_network_config = { for name, vm in var.vms : name => templatefile("${path.module}/cloud_init_network_config", {
+    ip = vm.ip
+    prefix = split("/", var.net_cidr)[1]
     gw = cidrhost(var.net_cidr, 1)
+    ip6 = vm.ip6
+    prefix6 = local.net_cidr6 != "" ? split("/", local.net_cidr6)[1] : ""
+    gw6 = local.net_cidr6 != "" ? cidrhost(local.net_cidr6, 1) : ""
     domain = var.dns_domain
-    iface = each.value.iface
+    iface = vm.iface
+    nics = [ for i, nic in vm.nics : {
+      name = "eth${i + 1}"
+      mac = nic.mac
+      ip = nic.ip
+      prefix = split("/", local.networks[nic.network].cidr)[1]
+    } ]
+  }) }
+}
+
+# Les fragments de user data de l'environnement puis ceux de la VM sont
+# fusionnés par cloud-init dans le template de base
+locals {
+  ci_fragments = { for name, vm in var.vms : name => concat(var.user_data != null ? var.user_data : [], vm.user_data) }
+}
+
+# Seules les VMs ayant des fragments ont un document MIME multi-part, les
+# autres reçoivent le template seul
+data "cloudinit_config" "ci_user_data" {
+  gzip = false
+  base64_encode = false
+
+  part {
+    content_type = "text/cloud-config"
+    content = local.ci_user_data[each.key]
+  }
+
+  dynamic "part" {
+    for_each = local.ci_fragments[each.key]
+    content {
+      content_type = "text/cloud-config"
+      content = file(part.value)
+      merge_type = "list(append)+dict(no_replace,recurse_list)+str()"
+    }
   }
+
+  for_each = { for name, vm in var.vms : name => vm if length(local.ci_fragments[name]) > 0 }
+}
+
+locals {
+  ci_user_data_rendered = merge(local.ci_user_data, { for name, c in data.cloudinit_config.ci_user_data : name => c.rendered })
+}
+
+# Le user data final est conservé pour pouvoir l'inspecter : un document
+# MIME multi-part dont les parties sont fusionnées par cloud-init quand la
+# VM a des fragments, le template seul sinon
+resource "local_file" "ci_user_data" {
+  filename = "${path.root}/cloud-init/${each.key}.${length(local.ci_fragments[each.key]) > 0 ? "mime" : "yaml"}"
+  content = local.ci_user_data_rendered[each.key]
+  file_permission = "0644"
   for_each = var.vms
 }
 
@@ -73,10 +279,17 @@ resource "libvirt_cloudinit_disk" "ci_disk" {
   name = "cloud_init-${each.key}.${var.dns_domain}.iso"
   pool = var.storage_pool
 
-  user_data = data.template_file.ci_user_data.rendered
+  user_data = local.ci_user_data_rendered[each.key]
   meta_data = data.template_file.ci_meta_data[each.key].rendered
-  network_config = data.template_file.ci_network_config[each.key].rendered
+  network_config = local.ci_network_config[each.key]
   for_each = var.vms
+
+  # cloud-init ne lit ces données qu'au premier démarrage, et un nouveau
+  # disque recréerait le domaine : les VMs existantes gardent le leur
+  # quand les templates changent
+  lifecycle {
+    ignore_changes = [ user_data, network_config ]
+  }
 }
 
 resource "libvirt_domain" "kvm" {
@@ -84,25 +297,78 @@ resource "libvirt_domain" "kvm" {
   memory = each.value.memory
   vcpu = each.value.vcpu
 
+  # Secure Boot a besoin du SMM, disponible seulement avec q35
+  machine = each.value.firmware == "uefi-secure" ? "q35" : null
+  firmware = contains(keys(local.firmwares), each.key) ? local.firmwares[each.key].code : null
+
+  dynamic "nvram" {
+    for_each = contains(keys(local.firmwares), each.key) ? [ local.firmwares[each.key] ] : []
+    content {
+      file = nvram.value.nvram
+      template = nvram.value.vars != "" ? nvram.value.vars : null
+    }
+  }
+
   network_interface {
-    addresses = [ each.value.ip ]
-    hostname = "${each.key}.${var.dns_domain}"
+    addresses = local.bridged ? null : [ each.value.ip ]
+    hostname = local.bridged ? null : "${each.key}.${var.dns_domain}"
     network_name = var.net_name
   }
 
+  dynamic "network_interface" {
+    for_each = each.value.nics
+    content {
+      network_id = libvirt_network.extra[network_interface.value.network].id
+      mac = network_interface.value.mac
+    }
+  }
+
   disk {
     volume_id = libvirt_volume.os_volume[each.key].id
-    scsi = true
+    scsi = local.devices[each.key].disk_bus == "scsi"
   }
 
-  disk {
-    volume_id = libvirt_volume.data_volume[each.key].id
-    scsi = true
+  dynamic "disk" {
+    for_each = each.value.disks
+    content {
+      volume_id = libvirt_volume.data_volume[disk.key == 0 ? each.key : "${each.key}_${disk.key}"].id
+      scsi = local.devices[each.key].disk_bus == "scsi"
+    }
+  }
+
+  # partages 9p, ceux en virtiofs sont ajoutés par la transformation XSLT
+  dynamic "filesystem" {
+    for_each = [ for i, sh in each.value.shares : { tag = "share${i}", source = sh.source } if sh.driver == "9p" ]
+    content {
+      source = filesystem.value.source
+      target = filesystem.value.tag
+      readonly = false
+      accessmode = "passthrough"
+    }
   }
 
   cloudinit = libvirt_cloudinit_disk.ci_disk[each.key].id
 
+  # canal de l'agent qemu-guest-agent, absent des VMs plus anciennes que
+  # son support : l'ajouter recréerait le domaine
+  qemu_agent = each.value.guest_agent
+
+  # le provider ne gère pas ces options, la définition du domaine est
+  # transformée seulement quand elles diffèrent des valeurs de libvirt
+  dynamic "xml" {
+    for_each = contains(keys(local.custom_domains), each.key) ? [ local.custom_domains[each.key] ] : []
+    content {
+      xslt = templatefile("${path.module}/domain.xsl", xml.value)
+    }
+  }
+
   for_each = var.vms
+
+  # carcass vm set changes the resources of the domain with libvirt, the
+  # provider would recreate it otherwise
+  lifecycle {
+    ignore_changes = [ memory, vcpu ]
+  }
 }
 
 terraform {
@@ -116,5 +382,13 @@ terraform {
       source = "hashicorp/template"
       version = "~> 2.1.2"
     }
+    cloudinit = {
+      source = "hashicorp/cloudinit"
+      version = "~> 2.2"
+    }
+    local = {
+      source = "hashicorp/local"
+      version = "~> 2.1"
+    }
   }
 }
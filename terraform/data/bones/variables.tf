@@ -10,11 +10,41 @@ variable "vms" {
   default = {
     pg = {
       ip = "10.10.0.2"
+      ip6 = "" # dans net_cidr6, vide hors dual-stack
       distrib = "centos7"
       vcpu = 1
       memory = 2048
-      data_size = 5368709120 # 5G
+      disks = [
+        {
+          size = 5368709120 # 5G
+          pool = "" # storage_pool
+        }
+      ]
       iface = "eth0"
+      # interfaces sur les réseaux de la variable networks, par exemple :
+      # { network = "replication", ip = "10.10.1.2", mac = "52:54:0a:0a:01:02" }
+      nics = []
+      user_data = [] # fichiers de user data cloud-init propres à la VM
+      groups = [] # utilisés par carcass pour sélectionner des VMs
+      boot_group = 0
+      instance_id = "" # instance-id cloud-init, renseigné pour les clones
+      # vides pour utiliser les valeurs par défaut du module
+      disk_bus = ""
+      disk_cache = ""
+      disk_io = ""
+      nic_model = ""
+      cpu_mode = "" # host-passthrough, host-model ou custom avec cpu_model
+      cpu_model = ""
+      cpu_sockets = 0 # topologie, sockets * cores * threads = vcpu
+      cpu_cores = 0
+      cpu_threads = 0
+      nested = false
+      firmware = "" # bios, uefi ou uefi-secure
+      # répertoires de l'hôte montés dans la VM, par exemple :
+      # { source = "/home/user/src", target = "/mnt/src", driver = "virtiofs" }
+      shares = []
+      guest_agent = true # canal de l'agent qemu
+      agent_package = true # installation de qemu-guest-agent par cloud-init
     }
   }
 }
@@ -29,6 +59,41 @@ variable "net_cidr" {
   default = "10.10.0.0/24"
 }
 
+variable "net_cidr6" {
+  description = "IPv6 network of the VMs in CIDR notation, for dual-stack environments, e.g. fd00:10::/64"
+  default = ""
+}
+
+variable "networks" {
+  description = "Isolated extra networks, by name, e.g. { replication = { cidr = \"10.10.1.0/24\" } }"
+  default = {}
+}
+
+variable "dns_records" {
+  description = "Extra DNS records of the network, e.g. [ { type = \"alias\", name = \"primary\", value = \"pg1\" }, { type = \"srv\", name = \"_postgresql._tcp\", value = \"pg1:5432\" } ]"
+  default = []
+}
+
+variable "net_mode" {
+  description = "Mode of the network: nat, route, isolated or bridge"
+  default = "nat"
+}
+
+variable "net_bridge" {
+  description = "Bridge of the host used by the network in bridge mode"
+  default = "br0"
+}
+
+variable "host_address" {
+  description = "Address of the host on the LAN in bridge mode, where cloud-init phones home. The gateway of the network when empty"
+  default = ""
+}
+
+variable "ip_range" {
+  description = "Range of addresses of the LAN reserved for the VMs in bridge mode, as FIRST-LAST, only used by carcass"
+  default = ""
+}
+
 variable "net_name" {
   description = "Name of the network inside libvirt"
   default = "carcass"
@@ -39,8 +104,62 @@ variable "user_name" {
   default = "carcass"
 }
 
+variable "user_data" {
+  description = "Cloud-init user data files merged into the base template of every VM"
+  default = []
+}
+
 variable "user_pubkey" {
   description = "Clé Publique SSH de l'utilisateur"
   default = ""
 }
 
+variable "phone_home_port" {
+  description = "TCP port where carcass waits for cloud-init to finish, on the gateway or host_address"
+  default = 8642
+}
+
+variable "disk_bus" {
+  description = "Default bus of the disks of the VMs: virtio, scsi or sata"
+  default = "scsi"
+}
+
+variable "disk_cache" {
+  description = "Default cache mode of the disks of the VMs, the one of libvirt when empty"
+  default = ""
+}
+
+variable "disk_io" {
+  description = "Default IO mode of the disks of the VMs, the one of libvirt when empty"
+  default = ""
+}
+
+variable "nic_model" {
+  description = "Default model of the network interfaces of the VMs"
+  default = "virtio"
+}
+
+variable "ovmf_code" {
+  description = "Path of the OVMF UEFI firmware on the hypervisor"
+  default = ""
+}
+
+variable "ovmf_vars" {
+  description = "Path of the template of the UEFI variables, copied to the NVRAM file of each VM. Chosen by libvirt when empty"
+  default = ""
+}
+
+variable "ovmf_secure_code" {
+  description = "Path of the OVMF UEFI firmware with Secure Boot on the hypervisor"
+  default = ""
+}
+
+variable "ovmf_secure_vars" {
+  description = "Path of the template of the UEFI variables with the Secure Boot keys enrolled. Chosen by libvirt when empty"
+  default = ""
+}
+
+variable "nvram_dir" {
+  description = "Directory where libvirt keeps the NVRAM files of the VMs on the hypervisor"
+  default = "/var/lib/libvirt/qemu/nvram"
+}
@@ -0,0 +1,158 @@
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package terraform
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+// ignoredChanges gives the attributes listed in the ignore_changes of the
+// lifecycle of a resource of the bones module
+func ignoredChanges(t *testing.T, resType string, resName string) []string {
+	src, err := data.ReadFile("data/bones/main.tf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, diags := hclsyntax.ParseConfig(src, "main.tf", hcl.Pos{Line: 1, Column: 1})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	for _, b := range file.Body.(*hclsyntax.Body).Blocks {
+		if b.Type != "resource" || len(b.Labels) != 2 || b.Labels[0] != resType || b.Labels[1] != resName {
+			continue
+		}
+
+		attrs := make([]string, 0)
+		for _, l := range b.Body.Blocks {
+			if l.Type != "lifecycle" {
+				continue
+			}
+
+			attr, ok := l.Body.Attributes["ignore_changes"]
+			if !ok {
+				continue
+			}
+
+			exprs, diags := hcl.ExprList(attr.Expr)
+			if diags.HasErrors() {
+				t.Fatal(diags)
+			}
+
+			for _, e := range exprs {
+				tr, diags := hcl.AbsTraversalForExpr(e)
+				if diags.HasErrors() {
+					t.Fatal(diags)
+				}
+				attrs = append(attrs, tr.RootName())
+			}
+		}
+
+		return attrs
+	}
+
+	t.Fatalf("resource %s.%s not found", resType, resName)
+	return nil
+}
+
+// TestIgnoredChanges checks that the attributes the templates of carcass
+// change do not make terraform replace the machines created before
+func TestIgnoredChanges(t *testing.T) {
+	var tests = []struct {
+		resType string
+		resName string
+		attr    string
+	}{
+		{"libvirt_cloudinit_disk", "ci_disk", "user_data"},
+		{"libvirt_cloudinit_disk", "ci_disk", "network_config"},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			found := false
+			for _, a := range ignoredChanges(t, st.resType, st.resName) {
+				if a == st.attr {
+					found = true
+				}
+			}
+
+			if !found {
+				t.Errorf("got: %s not ignored, want ignored in %s.%s", st.attr, st.resType, st.resName)
+			}
+		})
+	}
+}
+
+func TestInitNeeded(t *testing.T) {
+	src, err := data.ReadFile("data/bones/main.tf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	module := t.TempDir()
+	if err := os.WriteFile(filepath.Join(module, "main.tf"), src, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lock file of an environment created with the first module,
+	// which only required libvirt and template
+	baseline := `provider "registry.terraform.io/dmacvicar/libvirt" {
+  version     = "0.6.2"
+  constraints = "~> 0.6.2"
+}
+
+provider "registry.terraform.io/hashicorp/template" {
+  version     = "2.1.2"
+  constraints = "~> 2.1.2"
+}
+`
+	current := baseline + `
+provider "registry.terraform.io/hashicorp/cloudinit" {
+  version     = "2.2.0"
+  constraints = "~> 2.2"
+}
+
+provider "registry.terraform.io/hashicorp/local" {
+  version     = "2.1.0"
+  constraints = "~> 2.1"
+}
+`
+
+	var tests = []struct {
+		lock string
+		want bool
+	}{
+		{baseline, true},
+		{current, false},
+		{"", true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			dir := t.TempDir()
+			if st.lock != "" {
+				if err := os.WriteFile(filepath.Join(dir, ".terraform.lock.hcl"), []byte(st.lock), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := InitNeeded(dir, module)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != st.want {
+				t.Errorf("got: %v, want %v", got, st.want)
+			}
+		})
+	}
+}
@@ -5,9 +5,16 @@
 package terraform
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
 )
 
 // Init runs terraform init in the target directory, the main.tf configuration
@@ -16,10 +23,137 @@ func Init(binDir, dir string) error {
 	return runTerraform(binDir, dir, "init")
 }
 
+// InitNeeded tells if terraform init must run again in the target directory
+// before using the module at modulePath, because the module requires
+// providers missing from the dependency lock file. It happens when the module
+// is upgraded after the creation of an environment.
+func InitNeeded(dir string, modulePath string) (bool, error) {
+	if !filepath.IsAbs(modulePath) {
+		modulePath = filepath.Join(dir, modulePath)
+	}
+
+	required, err := requiredProviders(modulePath)
+	if err != nil {
+		return false, err
+	}
+
+	src, err := os.ReadFile(filepath.Join(dir, ".terraform.lock.hcl"))
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not read the dependency lock file: %w", err)
+	}
+
+	locked, err := lockedProviders(src)
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range required {
+		if !locked[p] {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// requiredProviders gives the fully qualified source addresses of the
+// providers listed in the required_providers of the module
+func requiredProviders(modulePath string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(modulePath, "*.tf"))
+	if err != nil {
+		return nil, err
+	}
+
+	providers := make([]string, 0)
+	for _, path := range files {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read module file: %w", err)
+		}
+
+		file, diags := hclsyntax.ParseConfig(src, path, hcl.Pos{Line: 1, Column: 1})
+		if diags.HasErrors() {
+			return nil, fmt.Errorf("could not parse %s: %s", path, diags)
+		}
+
+		for _, tb := range file.Body.(*hclsyntax.Body).Blocks {
+			if tb.Type != "terraform" {
+				continue
+			}
+
+			for _, rb := range tb.Body.Blocks {
+				if rb.Type != "required_providers" {
+					continue
+				}
+
+				for name, attr := range rb.Body.Attributes {
+					v, diags := attr.Expr.Value(nil)
+					if diags.HasErrors() {
+						return nil, fmt.Errorf("invalid required provider %s in %s: %s", name, path, diags)
+					}
+
+					source := "hashicorp/" + name
+					if v.Type().IsObjectType() && v.Type().HasAttribute("source") {
+						if s := v.GetAttr("source"); s.Type() == cty.String && s.IsKnown() && !s.IsNull() {
+							source = s.AsString()
+						}
+					}
+
+					providers = append(providers, providerAddress(source))
+				}
+			}
+		}
+	}
+
+	return providers, nil
+}
+
+// lockedProviders gives the providers found in a dependency lock file
+func lockedProviders(src []byte) (map[string]bool, error) {
+	file, diags := hclsyntax.ParseConfig(src, ".terraform.lock.hcl", hcl.Pos{Line: 1, Column: 1})
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("could not parse the dependency lock file: %s", diags)
+	}
+
+	locked := make(map[string]bool)
+	for _, b := range file.Body.(*hclsyntax.Body).Blocks {
+		if b.Type == "provider" && len(b.Labels) == 1 {
+			locked[providerAddress(b.Labels[0])] = true
+		}
+	}
+
+	return locked, nil
+}
+
+// providerAddress completes the source address of a provider with the
+// default registry hostname
+func providerAddress(source string) string {
+	source = strings.ToLower(source)
+	if strings.Count(source, "/") == 1 {
+		return "registry.terraform.io/" + source
+	}
+
+	return source
+}
+
 func Apply(binDir, dir string) error {
 	return runTerraform(binDir, dir, "apply", "-auto-approve")
 }
 
+// Import brings an existing object of the hypervisor, identified by id, under
+// the management of terraform at the resource address addr
+func Import(binDir, dir, addr, id string) error {
+	return runTerraform(binDir, dir, "import", addr, id)
+}
+
+// StateRemove makes terraform forget a resource without destroying it
+func StateRemove(binDir, dir, addr string) error {
+	return runTerraform(binDir, dir, "state", "rm", addr)
+}
+
 func Destroy(binDir, dir string) error {
 	return runTerraform(binDir, dir, "destroy", "-auto-approve")
 }